@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeRenewBefore 证书到期前多久续期
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// newACMEManager 根据 -acme-* 参数创建 ACME 证书管理器（证书保存在 -acme-cache 目录，到期前自动续期）
+func newACMEManager() (*autocert.Manager, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if acmeCAFile != "" {
+		// 信任本地 ACME 服务（如 Pebble）的 CA
+		pemData, err := os.ReadFile(acmeCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 ACME CA 文件失败: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("ACME CA 文件 %s 中没有有效的 PEM 证书", acmeCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &acmeOrderTransport{base: transport, orders: make(map[string]string)},
+	}
+
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(acmeDomains...),
+		Cache:       autocert.DirCache(acmeCacheDir),
+		Email:       acmeEmail,
+		RenewBefore: acmeRenewBefore,
+		Client: &acme.Client{
+			DirectoryURL: acmeDirectory,
+			HTTPClient:   httpClient,
+		},
+	}
+	log.Printf("已启用 ACME 证书: %v（目录 %s，缓存 %s）", []string(acmeDomains), acmeDirectory, acmeCacheDir)
+	return m, nil
+}
+
+// acmeGetCertificate 优先使用 -cert/-key 中与 SNI 匹配的证书，其余域名及 ACME 挑战交给 ACME 管理器
+func acmeGetCertificate(m *autocert.Manager, static *certStore) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if static == nil {
+		return m.GetCertificate
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			if cert := static.match(hello); cert != nil {
+				return cert, nil
+			}
+		}
+		return m.GetCertificate(hello)
+	}
+}
+
+// acmeHTTPHandler 应答 HTTP-01 挑战；监听端口非 80 时 Host 带端口，去掉后再交给域名白名单检查
+func acmeHTTPHandler(m *autocert.Manager) http.Handler {
+	h := m.HTTPHandler(nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			r.Host = host
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acmeOrderTransport 记录订单的 finalize 地址与订单地址的对应关系。
+// 异步签发的 ACME 服务（如 Pebble）在 finalize 响应中不返回 Location，
+// 而 acme.Client 依赖它轮询订单状态，此处补上订单地址
+type acmeOrderTransport struct {
+	base   http.RoundTripper
+	mu     sync.Mutex
+	orders map[string]string // finalize 地址 -> 订单地址
+}
+
+func (t *acmeOrderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return resp, err
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) != nil || order.Finalize == "" {
+		return resp, nil
+	}
+	reqURL := req.URL.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if reqURL == order.Finalize {
+		if resp.Header.Get("Location") == "" && t.orders[order.Finalize] != "" {
+			resp.Header.Set("Location", t.orders[order.Finalize])
+		}
+		return resp, nil
+	}
+	// 新建订单的响应带 Location；查询订单时请求地址即订单地址
+	orderURL := resp.Header.Get("Location")
+	if orderURL == "" {
+		orderURL = reqURL
+	}
+	t.orders[order.Finalize] = orderURL
+	return resp, nil
+}
+
+// splitTLSListener 在同一端口上区分 TLS 与明文 HTTP 连接（首字节为 0x16 即 TLS 握手），
+// 明文连接用于应答 ACME HTTP-01 挑战
+func splitTLSListener(ln net.Listener) (tlsLn, httpLn net.Listener) {
+	t := newChanListener(ln)
+	h := newChanListener(ln)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.closeWithError(err)
+				h.closeWithError(err)
+				return
+			}
+			go func() {
+				br := bufio.NewReader(conn)
+				_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				first, err := br.Peek(1)
+				_ = conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					conn.Close()
+					return
+				}
+				wrapped := &bufferedConn{Conn: conn, r: br}
+				if first[0] == 0x16 {
+					t.deliver(wrapped)
+				} else {
+					h.deliver(wrapped)
+				}
+			}()
+		}
+	}()
+	return t, h
+}
+
+// chanListener 由 splitTLSListener 分发连接的虚拟监听器
+type chanListener struct {
+	parent net.Listener
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newChanListener(parent net.Listener) *chanListener {
+	return &chanListener{parent: parent, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *chanListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *chanListener) closeWithError(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeWithError(net.ErrClosed)
+	return l.parent.Close()
+}
+
+func (l *chanListener) Addr() net.Addr { return l.parent.Addr() }
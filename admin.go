@@ -0,0 +1,276 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionView 管理接口中的一个通道
+type sessionView struct {
+	ID          uint64       `json:"id"`
+	Peer        string       `json:"peer"`
+	User        string       `json:"user,omitempty"`
+	Identity    string       `json:"identity,omitempty"`
+	ConnectedAt time.Time    `json:"connected_at"`
+	Age         string       `json:"age"`
+	StreamCount int          `json:"stream_count"`
+	BytesUp     int64        `json:"bytes_up"`   // 客户端→目标
+	BytesDown   int64        `json:"bytes_down"` // 目标→客户端
+	Streams     []streamView `json:"streams,omitempty"`
+}
+
+// streamView 管理接口中的一个流
+type streamView struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	Age       string    `json:"age"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// view 生成通道快照（调用方持有 l.mu），withStreams 时包含流列表
+func (s *channelSlot) view(now time.Time, withStreams bool) sessionView {
+	v := sessionView{
+		ID:          s.id,
+		Peer:        s.peer.addr,
+		User:        s.peer.user,
+		Identity:    s.peer.identity,
+		ConnectedAt: s.started,
+		Age:         now.Sub(s.started).Round(time.Second).String(),
+		StreamCount: len(s.streams),
+		BytesUp:     s.up.Load(),
+		BytesDown:   s.down.Load(),
+	}
+	if withStreams {
+		v.Streams = []streamView{}
+		for st := range s.streams {
+			v.Streams = append(v.Streams, streamView{
+				ID:        st.id,
+				Type:      st.kind,
+				Target:    st.target,
+				StartedAt: st.started,
+				Age:       now.Sub(st.started).Round(time.Second).String(),
+				BytesUp:   st.up.Load(),
+				BytesDown: st.down.Load(),
+			})
+		}
+		slices.SortFunc(v.Streams, func(a, b streamView) int { return a.StartedAt.Compare(b.StartedAt) })
+	}
+	return v
+}
+
+// sessions 返回全部通道的快照，按建立时间排序
+func (l *limiter) sessions() []sessionView {
+	now := time.Now()
+	l.mu.Lock()
+	list := make([]sessionView, 0, len(l.slots))
+	for s := range l.slots {
+		list = append(list, s.view(now, false))
+	}
+	l.mu.Unlock()
+	slices.SortFunc(list, func(a, b sessionView) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// session 返回指定通道的快照（含流列表）
+func (l *limiter) session(id uint64) (sessionView, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s := l.findSlot(id); s != nil {
+		return s.view(time.Now(), true), true
+	}
+	return sessionView{}, false
+}
+
+// findSlot 按 ID 查找通道（调用方持有 l.mu）
+func (l *limiter) findSlot(id uint64) *channelSlot {
+	for s := range l.slots {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// errNotFound 管理接口要关闭的通道或流不存在
+var errNotFound = errors.New("不存在")
+
+// closeSession 强制关闭通道及其中全部流
+func (l *limiter) closeSession(id uint64) error {
+	l.mu.Lock()
+	s := l.findSlot(id)
+	var fn func()
+	if s != nil {
+		fn = s.closeFn
+	}
+	l.mu.Unlock()
+	if s == nil {
+		return errNotFound
+	}
+	if fn == nil {
+		return errors.New("通道仍在建立中")
+	}
+	log.Printf("[管理] 关闭通道 #%d %s", id, s.peer)
+	fn()
+	return nil
+}
+
+// closeStream 强制关闭通道中的一个流
+func (l *limiter) closeStream(id uint64, streamID string) error {
+	l.mu.Lock()
+	var target *streamSlot
+	if s := l.findSlot(id); s != nil {
+		for st := range s.streams {
+			if st.id == streamID {
+				target = st
+				break
+			}
+		}
+	}
+	var fn func()
+	if target != nil {
+		fn = target.closeFn
+	}
+	l.mu.Unlock()
+	if target == nil {
+		return errNotFound
+	}
+	if fn == nil {
+		return errors.New("流仍在连接目标")
+	}
+	log.Printf("[管理] 关闭通道 #%d 的流 %s（%s %s）", id, streamID, target.kind, target.target)
+	fn()
+	return nil
+}
+
+// startAdminServer 在 -admin 指定的本机地址（回环 TCP 地址或 unix:/路径）提供管理接口
+func startAdminServer(addr string) error {
+	var ln net.Listener
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if isUnix {
+		// 套接字只允许当前用户访问
+		var err error
+		if ln, err = listenUnix(path, 0o600); err != nil {
+			return fmt.Errorf("管理接口监听失败: %v", err)
+		}
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("无效的 -admin 地址: %v", err)
+		}
+		if ip, err := netip.ParseAddr(host); host != "localhost" && (err != nil || !ip.IsLoopback()) {
+			return fmt.Errorf("-admin 只能监听回环地址或 unix 套接字: %s", addr)
+		}
+		if ln, err = listenInherited(addr); err != nil {
+			return fmt.Errorf("管理接口监听失败: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		channels, streams := limits.usage()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"channels": channels,
+			"streams":  streams,
+			"sessions": limits.sessions(),
+		})
+	})
+	mux.HandleFunc("GET /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := sessionID(w, r)
+		if !ok {
+			return
+		}
+		v, ok := limits.session(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "通道不存在"})
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := sessionID(w, r); ok {
+			writeCloseResult(w, limits.closeSession(id))
+		}
+	})
+	mux.HandleFunc("DELETE /sessions/{id}/streams/{stream}", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := sessionID(w, r); ok {
+			writeCloseResult(w, limits.closeStream(id, r.PathValue("stream")))
+		}
+	})
+
+	var handler http.Handler = mux
+	if !isUnix {
+		handler = requireLocalHost(addr, mux)
+	}
+
+	log.Printf("[管理] 管理接口监听 %s", addr)
+	go func() {
+		srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		if err := srv.Serve(ln); err != nil {
+			log.Printf("[管理] 管理接口停止: %v", err)
+		}
+	}()
+	return nil
+}
+
+// requireLocalHost 拒绝 Host 不是 localhost、回环地址或监听地址的请求：
+// 接口不做认证，仅监听回环地址无法阻止网页经 DNS 重绑定以浏览器身份访问
+func requireLocalHost(addr string, next http.Handler) http.Handler {
+	bindHost, _, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		switch host = strings.ToLower(host); host {
+		case "localhost", "127.0.0.1", "::1", strings.ToLower(bindHost):
+			next.ServeHTTP(w, r)
+		default:
+			log.Printf("[管理] 拒绝 Host 为 %q 的请求（来自 %s）", r.Host, r.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Host 不是本机地址"})
+		}
+	})
+}
+
+// sessionID 解析路径中的通道 ID，无效时写入 400 响应
+func sessionID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "无效的通道 ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeCloseResult 写入关闭操作的结果
+func writeCloseResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "通道或流不存在"})
+	default:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+}
+
+// writeJSON 以 JSON 写入响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
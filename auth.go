@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// authHeaderName 签名认证使用的握手头部
+	authHeaderName = "X-Tunnel-Auth"
+	// authContext 签名内容前缀，避免签名被用于其他用途
+	authContext = "ech-tunnel-auth-v1"
+	// nonceCacheLimit 重放缓存最多保存的 nonce 数
+	nonceCacheLimit = 1 << 20
+
+	authAlgHMAC    = "hmac-sha256"
+	authAlgEd25519 = "ed25519"
+)
+
+// authMessage 返回待签名内容
+func authMessage(alg, id string, ts int64, nonce string) []byte {
+	return []byte(authContext + "\n" + alg + "\n" + id + "\n" + strconv.FormatInt(ts, 10) + "\n" + nonce)
+}
+
+var (
+	authKeyOnce sync.Once
+	authKey     ed25519.PrivateKey
+	authKeyErr  error
+)
+
+// loadAuthKey 加载 -auth-key 指定的 Ed25519 私钥，文件不存在时生成并保存
+func loadAuthKey() (ed25519.PrivateKey, error) {
+	authKeyOnce.Do(func() {
+		data, err := os.ReadFile(authKeyFile)
+		if os.IsNotExist(err) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				authKeyErr = err
+				return
+			}
+			der, _ := x509.MarshalPKCS8PrivateKey(key)
+			if err := os.WriteFile(authKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+				authKeyErr = fmt.Errorf("保存认证私钥失败: %w", err)
+				return
+			}
+			log.Printf("[认证] 已生成 Ed25519 私钥 %s", authKeyFile)
+			authKey = key
+		} else if err != nil {
+			authKeyErr = fmt.Errorf("读取认证私钥失败: %w", err)
+			return
+		} else {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				authKeyErr = fmt.Errorf("认证私钥文件 %s 中没有 PEM 数据", authKeyFile)
+				return
+			}
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				authKeyErr = fmt.Errorf("解析认证私钥失败: %w", err)
+				return
+			}
+			key, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				authKeyErr = errors.New("认证私钥必须为 Ed25519 密钥")
+				return
+			}
+			authKey = key
+		}
+		pub := authKey.Public().(ed25519.PublicKey)
+		log.Printf("[认证] 客户端 %s 的公钥（填入服务端用户文件 public_key）: %s", authID, base64.StdEncoding.EncodeToString(pub))
+	})
+	return authKey, authKeyErr
+}
+
+// signedAuthHeader 生成签名认证头部：对客户端 ID、当前时间与随机 nonce 签名，每次握手都不同
+func signedAuthHeader() (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	ts := time.Now().Unix()
+
+	var alg string
+	var sig []byte
+	if authKeyFile != "" {
+		key, err := loadAuthKey()
+		if err != nil {
+			return "", err
+		}
+		alg = authAlgEd25519
+		sig = ed25519.Sign(key, authMessage(alg, authID, ts, nonce))
+	} else {
+		alg = authAlgHMAC
+		mac := hmac.New(sha256.New, []byte(authSecret))
+		mac.Write(authMessage(alg, authID, ts, nonce))
+		sig = mac.Sum(nil)
+	}
+
+	v := url.Values{}
+	v.Set("v", "1")
+	v.Set("alg", alg)
+	v.Set("id", authID)
+	v.Set("ts", strconv.FormatInt(ts, 10))
+	v.Set("nonce", nonce)
+	v.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+	return v.Encode(), nil
+}
+
+// parseEd25519PublicKey 解析 base64 编码的 Ed25519 公钥
+func parseEd25519PublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("长度应为 %d 字节", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// nonceCache 签名认证的重放缓存，nonce 保留到其时间戳超出允许偏差为止
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> 过期时间
+	lastSweep time.Time
+}
+
+var authNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// authStart 为进程启动时间（秒）。重放缓存仅在内存中，重启或 SIGUSR2 交接后清空，
+// 因此拒绝启动当秒及之前签发的签名，避免旧进程中捕获的头部被再次使用
+var authStart = time.Now().Unix()
+
+// add 记录 nonce，已存在（重放）或缓存已满时返回 false
+func (c *nonceCache) add(key string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > time.Minute || len(c.seen) >= nonceCacheLimit {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	if len(c.seen) >= nonceCacheLimit {
+		log.Printf("[认证] 重放缓存已满，拒绝签名认证")
+		return false
+	}
+	c.seen[key] = expires
+	return true
+}
+
+// verifySignedAuth 校验签名认证头部，返回用户名（使用 -auth-secret 共享密钥认证时为空）
+func (g *tunnelGate) verifySignedAuth(value string) (string, error) {
+	v, err := url.ParseQuery(value)
+	if err != nil || v.Get("v") != "1" {
+		return "", errors.New("签名认证头部格式无效")
+	}
+	alg, id, nonce := v.Get("alg"), v.Get("id"), v.Get("nonce")
+	ts, err := strconv.ParseInt(v.Get("ts"), 10, 64)
+	if err != nil || id == "" || len(nonce) < 16 || len(nonce) > 64 {
+		return "", errors.New("签名认证头部格式无效")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(v.Get("sig"))
+	if err != nil {
+		return "", errors.New("签名编码无效")
+	}
+
+	now := time.Now()
+	signedAt := time.Unix(ts, 0)
+	if d := now.Sub(signedAt); d > authSkew || d < -authSkew {
+		return "", fmt.Errorf("客户端 %s 时间偏差过大（%v）", id, d.Round(time.Second))
+	}
+	if ts <= authStart {
+		return "", fmt.Errorf("客户端 %s 的签名早于服务端启动时间", id)
+	}
+
+	// 按客户端 ID 查找用户凭据，未找到时使用 -auth-secret 共享密钥
+	var user string
+	var secret []byte
+	var publicKey ed25519.PublicKey
+	if entry := g.userEntry(id); entry != nil {
+		if !entry.active(now) {
+			return "", fmt.Errorf("用户 %s 已禁用或过期", id)
+		}
+		user, secret, publicKey = entry.name, entry.secret, entry.publicKey
+	} else if authSecret != "" {
+		secret = []byte(authSecret)
+	} else {
+		return "", fmt.Errorf("未知的客户端 %s", id)
+	}
+
+	msg := authMessage(alg, id, ts, nonce)
+	switch {
+	case alg == authAlgHMAC && secret != nil:
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(msg)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", fmt.Errorf("客户端 %s 签名无效", id)
+		}
+	case alg == authAlgEd25519 && publicKey != nil:
+		if !ed25519.Verify(publicKey, msg, sig) {
+			return "", fmt.Errorf("客户端 %s 签名无效", id)
+		}
+	default:
+		return "", fmt.Errorf("客户端 %s 不支持签名算法 %q", id, alg)
+	}
+
+	// 签名有效后才记录 nonce，nonce 在时间戳超出允许偏差前一直有效
+	if !authNonces.add(id+"|"+nonce, signedAt.Add(authSkew), now) {
+		return "", fmt.Errorf("客户端 %s 的签名已使用过（重放）", id)
+	}
+	if user == "" {
+		log.Printf("[认证] 客户端 %s 通过共享密钥签名认证", id)
+	}
+	return user, nil
+}
+
+// userEntry 在用户数据库中查找用户（未启用 -users 时返回 nil）
+func (g *tunnelGate) userEntry(name string) *userEntry {
+	if g.users == nil {
+		return nil
+	}
+	return g.users.lookup(name)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// certStore 服务端证书集合：按 SNI 选择证书，文件变化或收到 SIGHUP 时重新加载，已建立的通道不受影响
+type certStore struct {
+	certPaths []string
+	keyPaths  []string
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+}
+
+// newServerCertStore 加载 -cert/-key 指定的证书（逗号分隔，按顺序配对），未指定时使用 -state-dir 中的自签名证书
+func newServerCertStore(u *url.URL) (*certStore, error) {
+	certPaths := splitPathList(certFile)
+	keyPaths := splitPathList(keyFile)
+	if len(certPaths) != len(keyPaths) {
+		return nil, fmt.Errorf("-cert 与 -key 数量不一致（%d 与 %d）", len(certPaths), len(keyPaths))
+	}
+	if len(certPaths) == 0 {
+		cert, err := loadServerIdentity(u)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("未指定 -cert/-key，使用自签名证书")
+		return &certStore{certs: []*tls.Certificate{&cert}}, nil
+	}
+
+	s := &certStore{certPaths: certPaths, keyPaths: keyPaths}
+	paths := append(append([]string(nil), certPaths...), keyPaths...)
+	stamp := fileStamp(paths)
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	go watchFiles("证书", paths, stamp, s.reload)
+	return s, nil
+}
+
+// splitPathList 拆分逗号分隔的文件列表
+func splitPathList(s string) []string {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// GetCertificate 实现 tls.Config.GetCertificate：选择第一个与 SNI 及签名算法匹配的证书，均不匹配时使用第一个
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.match(hello); cert != nil {
+		return cert, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, errors.New("没有可用的证书")
+	}
+	return s.certs[0], nil
+}
+
+// match 返回第一个与 SNI 及签名算法匹配的证书，没有时返回 nil
+func (s *certStore) match(hello *tls.ClientHelloInfo) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// reload 重新加载全部证书；任一证书加载失败时保留原有证书
+func (s *certStore) reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.certPaths))
+	for i := range s.certPaths {
+		cert, err := tls.LoadX509KeyPair(s.certPaths[i], s.keyPaths[i])
+		if err != nil {
+			return fmt.Errorf("加载TLS证书失败 %s: %w", s.certPaths[i], err)
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	for _, cert := range certs {
+		log.Printf("[TLS] 已加载证书 %v（有效期至 %s）", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format("2006-01-02"))
+	}
+	return nil
+}
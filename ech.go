@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -16,9 +18,25 @@ import (
 
 // DNS查询相关常量
 const (
+	typeA     = 1  // DNS A 记录类型
+	typeAAAA  = 28 // DNS AAAA 记录类型
 	typeHTTPS = 65 // DNS HTTPS 记录类型
 )
 
+// HTTPS 记录中使用到的 SvcParamKey
+const (
+	svcParamIPv4Hint = 4
+	svcParamECH      = 5
+	svcParamIPv6Hint = 6
+)
+
+// dnsRecord DNS 响应中的单条回答记录
+type dnsRecord struct {
+	rrType uint16
+	ttl    uint32
+	data   []byte
+}
+
 var (
 	// 运行期缓存的 ECHConfigList
 	echListMu sync.RWMutex
@@ -28,8 +46,8 @@ var (
 // prepareECH 客户端启动时查询 ECH 配置并缓存
 func prepareECH() error {
 	for {
-		log.Printf("[客户端] 使用 DNS 服务器查询 ECH: %s -> %s", dnsServer, echDomain)
-		echBase64, err := queryHTTPSRecord(echDomain, dnsServer)
+		log.Printf("[客户端] 使用 DNS 服务器查询 ECH: %s -> %s", dnsServers.String(), echDomain)
+		echBase64, err := queryHTTPSRecord(echDomain)
 		if err != nil {
 			log.Printf("[客户端] DNS 查询失败: %v，2秒后重试...", err)
 			time.Sleep(2 * time.Second)
@@ -70,58 +88,151 @@ func getECHList() ([]byte, error) {
 	return echList, nil
 }
 
-// queryHTTPSRecord 查询 DNS HTTPS 记录
-func queryHTTPSRecord(domain, dnsServer string) (string, error) {
-	dohURL := dnsServer
-	if !strings.HasPrefix(dohURL, "https://") && !strings.HasPrefix(dohURL, "http://") {
-		dohURL = "https://" + dohURL
+// dohServer 单个 DoH 服务器及其可选的引导地址
+type dohServer struct {
+	url       string
+	bootstrap []net.IP
+	client    *http.Client
+}
+
+var (
+	dohServersOnce sync.Once
+	dohServerList  []*dohServer
+	dohServersErr  error
+)
+
+// parseDoHServer 解析 -dns 条目，格式: [https://]host[:port]/path[#引导IP1,引导IP2]
+func parseDoHServer(entry string) (*dohServer, error) {
+	entry = strings.TrimSpace(entry)
+	var bootstrapStr string
+	if i := strings.Index(entry, "#"); i >= 0 {
+		entry, bootstrapStr = entry[:i], entry[i+1:]
+	}
+	if !strings.HasPrefix(entry, "https://") && !strings.HasPrefix(entry, "http://") {
+		entry = "https://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("无效的 DoH 地址 %s: %v", entry, err)
+	}
+
+	server := &dohServer{url: entry}
+	for _, s := range strings.Split(bootstrapStr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(s, "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("无效的 DoH 引导 IP: %s", s)
+		}
+		server.bootstrap = append(server.bootstrap, ip)
+	}
+
+	transport := &http.Transport{
+		// 经上游代理（如有）连接 DoH 服务器，主机名交由代理解析
+		DialContext:         dialOutbound,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 3 * time.Second,
+	}
+	if len(server.bootstrap) > 0 {
+		// 直接连接引导 IP，证书仍按 URL 中的主机名校验，完全绕开系统 DNS
+		bootstrap := server.bootstrap
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			return dialHappyEyeballs(ctx, network, host, bootstrap, port)
+		}
+	}
+	server.client = &http.Client{Timeout: 3 * time.Second, Transport: transport}
+	return server, nil
+}
+
+// getDoHServers 返回 -dns 配置的 DoH 服务器列表（按顺序尝试）
+func getDoHServers() ([]*dohServer, error) {
+	dohServersOnce.Do(func() {
+		for _, entry := range dnsServers {
+			server, err := parseDoHServer(entry)
+			if err != nil {
+				dohServersErr = err
+				return
+			}
+			dohServerList = append(dohServerList, server)
+		}
+	})
+	return dohServerList, dohServersErr
+}
+
+// queryHTTPSRecord 查询 DNS HTTPS 记录，返回 Base64 编码的 ECH 配置
+func queryHTTPSRecord(domain string) (string, error) {
+	body, err := queryDoH(domain, typeHTTPS)
+	if err != nil {
+		return "", err
 	}
-	return queryDoH(domain, dohURL)
+	return parseDNSResponse(body)
 }
 
-// queryDoH 通过 DoH (DNS over HTTPS) 查询
-func queryDoH(domain, dohURL string) (string, error) {
-	u, err := url.Parse(dohURL)
+// queryDoHRecords 通过 -dns 指定的 DoH 服务器查询任意类型记录
+func queryDoHRecords(domain string, qtype uint16) ([]dnsRecord, error) {
+	body, err := queryDoH(domain, qtype)
 	if err != nil {
-		return "", fmt.Errorf("无效的 DoH URL: %v", err)
+		return nil, err
 	}
-	q := u.Query()
-	q.Set("name", domain)
-	q.Set("type", "HTTPS")
-	dnsQuery := buildDNSQuery(domain, typeHTTPS)
-	dnsBase64 := base64.RawURLEncoding.EncodeToString(dnsQuery)
+	return parseDNSAnswers(body)
+}
 
-	q.Set("dns", dnsBase64)
-	// 移除 name 和 type，因为使用了 dns 参数
-	q.Del("name")
-	q.Del("type")
+// queryDoH 依次尝试各 DoH 服务器，返回第一个成功的原始 DNS 响应
+func queryDoH(domain string, qtype uint16) ([]byte, error) {
+	servers, err := getDoHServers()
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, server := range servers {
+		body, err := dohExchange(domain, qtype, server)
+		if err == nil {
+			return body, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", server.url, err))
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
 
+// dohExchange 向单个 DoH 服务器发送一次查询并返回原始 DNS 响应报文
+func dohExchange(domain string, qtype uint16, server *dohServer) ([]byte, error) {
+	u, err := url.Parse(server.url)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 DoH URL: %v", err)
+	}
+	q := u.Query()
+	dnsQuery := buildDNSQuery(domain, qtype)
+	q.Set("dns", base64.RawURLEncoding.EncodeToString(dnsQuery))
 	u.RawQuery = q.Encode()
 
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %v", err)
+		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
 	req.Header.Set("Accept", "application/dns-message")
 	req.Header.Set("Content-Type", "application/dns-message")
 
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := server.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("DoH 请求失败: %v", err)
+		return nil, fmt.Errorf("DoH 请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
+		return nil, fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("读取 DoH 响应失败: %v", err)
+		return nil, fmt.Errorf("读取 DoH 响应失败: %v", err)
 	}
-
-	return parseDNSResponse(body)
+	return body, nil
 }
 
 // buildDNSQuery 构建 DNS 查询报文
@@ -144,23 +255,47 @@ func buildDNSQuery(domain string, qtype uint16) []byte {
 	return query
 }
 
-// parseDNSResponse 解析 DNS 响应报文
+// parseDNSResponse 解析 DNS 响应报文，返回 HTTPS 记录中的 ECH 配置
 func parseDNSResponse(response []byte) (string, error) {
-	if len(response) < 12 {
-		return "", fmt.Errorf("响应长度无效")
+	records, err := parseDNSAnswers(response)
+	if err != nil {
+		return "", err
 	}
-	ancount := binary.BigEndian.Uint16(response[6:8])
-	if ancount == 0 {
+	if len(records) == 0 {
 		return "", fmt.Errorf("未找到回答记录")
 	}
+	for _, rr := range records {
+		if rr.rrType == typeHTTPS {
+			if ech := parseHTTPSRecord(rr.data); ech != "" {
+				return ech, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseDNSAnswers 解析 DNS 响应报文中的回答记录
+func parseDNSAnswers(response []byte) ([]dnsRecord, error) {
+	if len(response) < 12 {
+		return nil, fmt.Errorf("响应长度无效")
+	}
+	if rcode := response[3] & 0x0F; rcode != 0 {
+		return nil, fmt.Errorf("DNS 响应错误码: %d", rcode)
+	}
+	ancount := binary.BigEndian.Uint16(response[6:8])
 	// 跳过 Question
 	offset := 12
 	for offset < len(response) && response[offset] != 0 {
+		if response[offset]&0xC0 == 0xC0 {
+			offset++
+			break
+		}
 		offset += int(response[offset]) + 1
 	}
 	offset += 5 // null + type + class
 
 	// Answers
+	var records []dnsRecord
 	for i := 0; i < int(ancount); i++ {
 		if offset >= len(response) {
 			break
@@ -170,6 +305,10 @@ func parseDNSResponse(response []byte) (string, error) {
 			offset += 2
 		} else {
 			for offset < len(response) && response[offset] != 0 {
+				if response[offset]&0xC0 == 0xC0 {
+					offset++
+					break
+				}
 				offset += int(response[offset]) + 1
 			}
 			offset++
@@ -178,28 +317,49 @@ func parseDNSResponse(response []byte) (string, error) {
 			break
 		}
 		rrType := binary.BigEndian.Uint16(response[offset : offset+2])
+		ttl := binary.BigEndian.Uint32(response[offset+4 : offset+8])
 		offset += 8 // type(2) + class(2) + ttl(4)
 		dataLen := binary.BigEndian.Uint16(response[offset : offset+2])
 		offset += 2
 		if offset+int(dataLen) > len(response) {
 			break
 		}
-		data := response[offset : offset+int(dataLen)]
+		records = append(records, dnsRecord{
+			rrType: rrType,
+			ttl:    ttl,
+			data:   response[offset : offset+int(dataLen)],
+		})
 		offset += int(dataLen)
-
-		if rrType == typeHTTPS {
-			if ech := parseHTTPSRecord(data); ech != "" {
-				return ech, nil
-			}
-		}
 	}
-	return "", nil
+	return records, nil
 }
 
 // parseHTTPSRecord 解析 HTTPS 记录，仅抽取 SvcParamKey == 5 (ECHConfigList/echconfig)
 func parseHTTPSRecord(data []byte) string {
+	if value, ok := parseSvcParams(data)[svcParamECH]; ok {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	return ""
+}
+
+// parseHTTPSHints 解析 HTTPS 记录中的 ipv4hint/ipv6hint
+func parseHTTPSHints(data []byte) []net.IP {
+	params := parseSvcParams(data)
+	var ips []net.IP
+	for i := 0; i+net.IPv4len <= len(params[svcParamIPv4Hint]); i += net.IPv4len {
+		ips = append(ips, net.IP(params[svcParamIPv4Hint][i:i+net.IPv4len]))
+	}
+	for i := 0; i+net.IPv6len <= len(params[svcParamIPv6Hint]); i += net.IPv6len {
+		ips = append(ips, net.IP(params[svcParamIPv6Hint][i:i+net.IPv6len]))
+	}
+	return ips
+}
+
+// parseSvcParams 解析 HTTPS 记录的 SvcParams 为 key -> value
+func parseSvcParams(data []byte) map[uint16][]byte {
+	params := make(map[uint16][]byte)
 	if len(data) < 2 {
-		return ""
+		return params
 	}
 	// 跳 priority(2)
 	offset := 2
@@ -220,11 +380,8 @@ func parseHTTPSRecord(data []byte) string {
 		if offset+int(length) > len(data) {
 			break
 		}
-		value := data[offset : offset+int(length)]
+		params[key] = data[offset : offset+int(length)]
 		offset += int(length)
-		if key == 5 {
-			return base64.StdEncoding.EncodeToString(value)
-		}
 	}
-	return ""
+	return params
 }
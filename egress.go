@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 目标被拒绝的原因代码（REFUSED 帧）
+const (
+	refusePolicy  = "policy"  // 访问控制策略拒绝
+	refuseResolve = "resolve" // 目标域名解析失败
+	refuseConnect = "connect" // 连接目标失败
+)
+
+// refusalError 服务端拒绝或无法连接目标，以 REFUSED:<connID>|<code>|<reason> 通知客户端
+type refusalError struct {
+	code   string
+	reason string
+}
+
+func (e *refusalError) Error() string {
+	return e.code + ": " + e.reason
+}
+
+// refusalFrame 生成 REFUSED 帧
+func refusalFrame(connID string, err error) []byte {
+	var r *refusalError
+	if !errors.As(err, &r) {
+		r = &refusalError{code: refuseConnect, reason: err.Error()}
+	}
+	return []byte("REFUSED:" + connID + "|" + r.code + "|" + r.reason)
+}
+
+// parseRefusal 解析 REFUSED 帧内容（去掉前缀后的部分）
+func parseRefusal(s string) (string, *refusalError) {
+	parts := strings.SplitN(s, "|", 3)
+	r := &refusalError{code: refuseConnect}
+	if len(parts) > 1 {
+		r.code = parts[1]
+	}
+	if len(parts) > 2 {
+		r.reason = parts[2]
+	}
+	return parts[0], r
+}
+
+// egressRule 目标访问规则：<主机>[:<端口或端口范围>]
+// 主机可为 *（任意）、IP、CIDR、域名（完全匹配）或 *.example.com / .example.com（子域名）
+type egressRule struct {
+	text   string
+	any    bool
+	prefix netip.Prefix
+	domain string
+	suffix bool
+	portLo int
+	portHi int
+}
+
+// parseEgressRule 解析一条规则
+func parseEgressRule(s string) (egressRule, error) {
+	r := egressRule{text: s, portLo: 0, portHi: 65535}
+	host, ports := s, ""
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return r, fmt.Errorf("无效的规则: %s", s)
+		}
+		host, ports = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	case strings.Count(s, ":") == 1:
+		host, ports, _ = strings.Cut(s, ":")
+	}
+
+	if ports != "" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		var err error
+		if r.portLo, err = strconv.Atoi(lo); err != nil || r.portLo < 0 || r.portLo > 65535 {
+			return r, fmt.Errorf("规则 %s 的端口无效", s)
+		}
+		r.portHi = r.portLo
+		if isRange {
+			if r.portHi, err = strconv.Atoi(hi); err != nil || r.portHi < r.portLo || r.portHi > 65535 {
+				return r, fmt.Errorf("规则 %s 的端口范围无效", s)
+			}
+		}
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case host == "*" || host == "":
+		r.any = true
+	case strings.Contains(host, "/"):
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return r, fmt.Errorf("规则 %s 的 CIDR 无效: %v", s, err)
+		}
+		r.prefix = p.Masked()
+	default:
+		if ip, err := netip.ParseAddr(host); err == nil {
+			r.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		} else if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+			r.domain = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+			r.suffix = true
+		} else {
+			r.domain = host
+		}
+	}
+	return r, nil
+}
+
+// matchHost 判断域名是否匹配域名规则
+func (r *egressRule) matchHost(host string) bool {
+	if r.domain == "" || host == "" {
+		return false
+	}
+	if r.suffix {
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	}
+	return host == r.domain
+}
+
+// match 判断目标（请求的域名、解析后的 IP、端口）是否匹配规则
+func (r *egressRule) match(host string, ip netip.Addr, port int) bool {
+	if port < r.portLo || port > r.portHi {
+		return false
+	}
+	return r.any || r.prefix.IsValid() && r.prefix.Contains(ip) || r.matchHost(host)
+}
+
+// egressPolicy 目标访问策略：拒绝规则优先；允许列表非空时只允许匹配的目标；
+// 内网、回环等地址默认拒绝，除非 allowPrivate 或有 IP/CIDR 允许规则明确覆盖
+type egressPolicy struct {
+	allow        []egressRule
+	deny         []egressRule
+	allowPrivate bool
+}
+
+// newEgressPolicy 由规则列表创建策略（每项可用逗号分隔多条规则）
+func newEgressPolicy(allow, deny []string, allowPrivate bool) (*egressPolicy, error) {
+	p := &egressPolicy{allowPrivate: allowPrivate}
+	for _, list := range []struct {
+		items []string
+		rules *[]egressRule
+	}{{allow, &p.allow}, {deny, &p.deny}} {
+		for _, item := range list.items {
+			for _, s := range strings.Split(item, ",") {
+				if s = strings.TrimSpace(s); s == "" {
+					continue
+				}
+				r, err := parseEgressRule(s)
+				if err != nil {
+					return nil, err
+				}
+				*list.rules = append(*list.rules, r)
+			}
+		}
+	}
+	return p, nil
+}
+
+// internalPrefixes 默认拒绝的地址范围（除 netip 已能识别的回环、私有、链路本地、组播等）
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// isInternalAddr 判断是否为回环、私有、链路本地（含云元数据 169.254.169.254）等内部地址
+func isInternalAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, p := range internalPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check 检查解析后的单个地址，拒绝时返回原因
+func (p *egressPolicy) check(host string, ip netip.Addr, port int) error {
+	ip = ip.Unmap()
+	for i := range p.deny {
+		if p.deny[i].match(host, ip, port) {
+			return &refusalError{code: refusePolicy, reason: "命中拒绝规则 " + p.deny[i].text}
+		}
+	}
+	if isInternalAddr(ip) && !p.allowPrivate {
+		explicit := false
+		for i := range p.allow {
+			r := &p.allow[i]
+			if r.prefix.IsValid() && r.prefix.Contains(ip) && port >= r.portLo && port <= r.portHi {
+				explicit = true
+				break
+			}
+		}
+		if !explicit {
+			return &refusalError{code: refusePolicy, reason: "禁止访问内部地址 " + ip.String()}
+		}
+	}
+	if len(p.allow) > 0 {
+		for i := range p.allow {
+			if p.allow[i].match(host, ip, port) {
+				return nil
+			}
+		}
+		return &refusalError{code: refusePolicy, reason: "目标不在允许列表中"}
+	}
+	return nil
+}
+
+var (
+	egressOnce   sync.Once
+	globalEgress *egressPolicy
+	egressErr    error
+)
+
+// getEgressPolicy 返回命令行参数指定的全局目标访问策略
+func getEgressPolicy() (*egressPolicy, error) {
+	egressOnce.Do(func() {
+		globalEgress, egressErr = newEgressPolicy(egressAllow, egressDeny, egressAllowPrivate)
+		if egressErr == nil && egressAllowPrivate {
+			log.Printf("[策略] 已允许访问内网与回环地址 (-egress-allow-private)")
+		}
+	})
+	return globalEgress, egressErr
+}
+
+// egressPolicyFor 返回通道适用的策略：用户文件中为该用户配置了 egress 时使用用户策略，否则使用全局策略
+func egressPolicyFor(peer peerInfo) *egressPolicy {
+	if peer.user != "" {
+		if db, _ := getUserDB(); db != nil {
+			if u := db.lookup(peer.user); u != nil && u.egress != nil {
+				return u.egress
+			}
+		}
+	}
+	p, _ := getEgressPolicy()
+	return p
+}
+
+// resolveTarget 解析目标并逐个地址检查策略，返回允许连接的地址与所用出站
+// 策略作用于解析结果，且随后直接连接这些地址，DNS 重绑定无法绕过
+func resolveTarget(ctx context.Context, peer peerInfo, network, target string) ([]netip.AddrPort, *outbound, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, &refusalError{code: refuseResolve, reason: "目标地址无效"}
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, nil, &refusalError{code: refuseResolve, reason: "目标端口无效"}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+		host = ""
+	} else if ips, err = lookupTarget(ctx, host); err != nil {
+		return nil, nil, &refusalError{code: refuseResolve, reason: err.Error()}
+	}
+
+	policy := egressPolicyFor(peer)
+	var allowed []netip.AddrPort
+	var firstErr error
+	for _, ip := range ips {
+		if err := policy.check(host, ip, port); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		allowed = append(allowed, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+	}
+	if len(allowed) == 0 {
+		if firstErr == nil {
+			firstErr = &refusalError{code: refuseResolve, reason: "没有可用的地址"}
+		}
+		log.Printf("[策略] 拒绝 %s 访问 %s: %v", peer, target, firstErr)
+		return nil, nil, firstErr
+	}
+	out := outboundFor(peer, host, allowed[0].Addr(), port)
+	if out != directOutbound {
+		log.Printf("[出站] %s 经 %s 访问 %s", peer, out.name, target)
+	}
+	return allowed, out, nil
+}
+
+// dialTarget 按策略解析目标后经所选出站依次尝试连接允许的地址
+func dialTarget(ctx context.Context, peer peerInfo, target string) (net.Conn, error) {
+	addrs, out, err := resolveTarget(ctx, peer, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := out.dial(ctx, addrs)
+	if err != nil {
+		return nil, &refusalError{code: refuseConnect, reason: err.Error()}
+	}
+	return conn, nil
+}
+
+// listenUDPTarget 按策略解析 UDP 目标，并经所选出站创建收发套接字
+func listenUDPTarget(ctx context.Context, peer peerInfo, target string) (udpSocket, *net.UDPAddr, error) {
+	addrs, out, err := resolveTarget(ctx, peer, "udp", target)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := out.order(addrs)[0]
+	conn, err := out.listenUDP(ctx, addr)
+	if err != nil {
+		return nil, nil, &refusalError{code: refuseConnect, reason: err.Error()}
+	}
+	return conn, net.UDPAddrFromAddrPort(addr), nil
+}
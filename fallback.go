@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// newFallbackHandler 根据 -fallback 创建伪装站点：http(s):// 地址时反向代理到该站点，否则作为静态文件目录
+func newFallbackHandler(target string) (http.Handler, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("无效的 -fallback 地址: %s", target)
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				// 以上游站点自身的 Host 请求，且不添加 X-Forwarded-* 头部
+				pr.SetURL(u)
+				// 不把隧道凭据转发给上游
+				pr.Out.Header.Del(authHeaderName)
+				pr.Out.Header.Del("Sec-WebSocket-Protocol")
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("[伪装] 请求上游站点失败 %s: %v", r.URL.Path, err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			},
+		}
+		log.Printf("[伪装] 非隧道请求反向代理到 %s", u.Redacted())
+		return proxy, nil
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("读取 -fallback 目录失败: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("-fallback 应为目录或 http(s):// 地址: %s", target)
+	}
+	log.Printf("[伪装] 非隧道请求使用静态目录 %s", target)
+	return http.FileServer(http.Dir(target)), nil
+}
+
+// isTunnelRequest 判断请求是否可能是隧道通道请求（WebSocket 升级、extended CONNECT 或 HTTP 流式传输）
+func isTunnelRequest(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r) || isExtendedConnect(r) || isStreamRequest(r)
+}
+
+// authorizeOrFallback 进行准入检查；配置了伪装站点时，未通过的请求由伪装站点响应而不是返回错误状态
+func authorizeOrFallback(gate *tunnelGate, fallback http.Handler, w http.ResponseWriter, r *http.Request) (peerInfo, bool) {
+	if fallback == nil {
+		return gate.authorize(w, r)
+	}
+	peer, ok := gate.authorize(&helloWriter{header: make(http.Header), status: http.StatusOK}, r)
+	if !ok {
+		fallback.ServeHTTP(w, r)
+	}
+	return peer, ok
+}
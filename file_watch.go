@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// fileWatchInterval 检查配置文件变化的间隔
+const fileWatchInterval = 5 * time.Second
+
+// fileStamp 返回各文件的修改时间与大小，用于判断是否需要重新加载
+func fileStamp(paths []string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d;", p, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&b, "%s:-;", p)
+		}
+	}
+	return b.String()
+}
+
+// watchFiles 定期检查文件变化，变化或收到重载信号时调用 reload
+// stamp 为首次加载前取得的文件状态；加载失败时保留原配置，文件再次变化前不重复尝试
+func watchFiles(what string, paths []string, stamp string, reload func() error) {
+	sig := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(sig, reloadSignals...)
+	}
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+	failed := ""
+	for {
+		select {
+		case <-ticker.C:
+			current := fileStamp(paths)
+			if current == stamp || current == failed {
+				continue
+			}
+			log.Printf("检测到%s文件变化，重新加载", what)
+		case <-sig:
+			log.Printf("收到重载信号，重新加载%s", what)
+		}
+		current := fileStamp(paths)
+		if err := reload(); err != nil {
+			failed = current
+			log.Printf("重新加载%s失败，继续使用原配置: %v", what, err)
+			continue
+		}
+		stamp = current
+	}
+}
@@ -1,8 +1,18 @@
 module ech-tunnel
 
-go 1.21
+go 1.24.0
 
 require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.44.0
+	golang.org/x/net v0.47.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/kr/text v0.2.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
 )
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ensureGODEBUG 检查进程是否以指定的 GODEBUG 设置运行（非 Unix 平台无法重新执行自身，需手动设置环境变量）
+func ensureGODEBUG(setting string) error {
+	for _, s := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(s) == setting {
+			return nil
+		}
+	}
+	return fmt.Errorf("请设置环境变量 GODEBUG=%s 后重新启动", setting)
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ensureGODEBUG 确保进程以指定的 GODEBUG 设置运行
+// net/http 只在包初始化时读取 GODEBUG 环境变量，因此缺少该设置时以追加后的环境重新执行自身
+func ensureGODEBUG(setting string) error {
+	current := os.Getenv("GODEBUG")
+	for _, s := range strings.Split(current, ",") {
+		if strings.TrimSpace(s) == setting {
+			return nil
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	value := setting
+	if current != "" {
+		value = current + "," + setting
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GODEBUG=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "GODEBUG="+value)
+	log.Printf("以 GODEBUG=%s 重新启动进程", value)
+	return syscall.Exec(exe, os.Args, env)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -76,9 +77,9 @@ func handleHTTPConnect(conn net.Conn, reader *bufio.Reader, config *ProxyConfig,
 	_ = conn.SetDeadline(time.Time{})
 
 	echPool.RegisterAndClaim(connID, target, "", conn)
-	if !echPool.WaitConnected(connID, 5*time.Second) {
-		log.Printf("[HTTP:%s] CONNECT 超时", clientAddr)
-		conn.Write([]byte("HTTP/1.1 504 Gateway Timeout\r\n\r\n"))
+	if err := echPool.WaitConnectedErr(connID, 5*time.Second); err != nil {
+		log.Printf("[HTTP:%s] CONNECT 失败: %v", clientAddr, err)
+		conn.Write([]byte("HTTP/1.1 " + httpStatusFor(err) + "\r\nProxy-Status: " + proxyStatusFor(err) + "\r\n\r\n"))
 		return
 	}
 
@@ -209,9 +210,9 @@ func handleHTTPForward(conn net.Conn, reader *bufio.Reader, config *ProxyConfig,
 	_ = conn.SetDeadline(time.Time{})
 
 	echPool.RegisterAndClaim(connID, target, firstFrameData, conn)
-	if !echPool.WaitConnected(connID, 5*time.Second) {
-		log.Printf("[HTTP:%s] 连接超时", clientAddr)
-		conn.Write([]byte("HTTP/1.1 504 Gateway Timeout\r\n\r\n"))
+	if err := echPool.WaitConnectedErr(connID, 5*time.Second); err != nil {
+		log.Printf("[HTTP:%s] 连接失败: %v", clientAddr, err)
+		conn.Write([]byte("HTTP/1.1 " + httpStatusFor(err) + "\r\nProxy-Status: " + proxyStatusFor(err) + "\r\n\r\n"))
 		return
 	}
 
@@ -269,6 +270,40 @@ func readHTTPHeaders(reader *bufio.Reader) (map[string]string, error) {
 	return headers, nil
 }
 
+// httpStatusFor 将服务端拒绝原因映射为 HTTP 状态行
+func httpStatusFor(err error) string {
+	var r *refusalError
+	if errors.As(err, &r) {
+		switch r.code {
+		case refusePolicy:
+			return "403 Forbidden"
+		case refuseLimit:
+			return "429 Too Many Requests"
+		}
+		return "502 Bad Gateway"
+	}
+	return "504 Gateway Timeout"
+}
+
+// proxyStatusFor 生成 Proxy-Status 头部（RFC 9209），区分解析失败、策略拒绝等原因
+func proxyStatusFor(err error) string {
+	kind := "connection_timeout"
+	var r *refusalError
+	if errors.As(err, &r) {
+		switch r.code {
+		case refuseResolve:
+			kind = "dns_error"
+		case refusePolicy:
+			kind = "destination_ip_prohibited"
+		case refuseLimit:
+			kind = "connection_limit_reached"
+		default:
+			kind = "destination_unavailable"
+		}
+	}
+	return "ech-tunnel; error=" + kind
+}
+
 // validateProxyAuth 验证 HTTP 代理认证
 func validateProxyAuth(authHeader, username, password string) bool {
 	if authHeader == "" {
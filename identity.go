@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// identityValidity 自签名证书有效期
+	identityValidity = 10 * 365 * 24 * time.Hour
+	// identityRenewBefore 自签名证书到期前多久重新签发（沿用原密钥，公钥指纹不变）
+	identityRenewBefore = 30 * 24 * time.Hour
+)
+
+// loadServerIdentity 加载或生成持久化的自签名服务端证书（保存在 -state-dir）
+// 密钥只生成一次；SAN 变化或临近到期时用原密钥重新签发，客户端的 -pin 始终有效
+func loadServerIdentity(u *url.URL) (tls.Certificate, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("创建状态目录失败: %w", err)
+	}
+	keyPath := filepath.Join(stateDir, "server.key")
+	certPath := filepath.Join(stateDir, "server.crt")
+
+	key, err := loadOrCreateIdentityKey(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	names := identityNames(u.Hostname())
+
+	var der []byte
+	if leaf, err := loadPEMCertificate(certPath); err == nil && identityCertValid(leaf, key, names) {
+		der = leaf.Raw
+	} else {
+		if der, err = createIdentityCert(key, names); err != nil {
+			return tls.Certificate{}, fmt.Errorf("生成自签名证书时出错: %w", err)
+		}
+		if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("保存自签名证书失败: %w", err)
+		}
+		log.Printf("[TLS] 已签发自签名证书 %s（SAN: %s）", certPath, strings.Join(names, ", "))
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	printClientCommand(u, leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// loadOrCreateIdentityKey 读取 PKCS#8 私钥，不存在或类型与 -cert-type 不符时生成新密钥
+func loadOrCreateIdentityKey(path string) (crypto.Signer, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("私钥文件 %s 中没有 PEM 数据", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析私钥 %s 失败: %w", path, err)
+		}
+		key, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("不支持的私钥类型: %T", parsed)
+		}
+		if identityKeyType(key) == certType {
+			return key, nil
+		}
+		log.Printf("[TLS] 已有私钥类型为 %s，按 -cert-type %s 重新生成（公钥指纹将变化）", identityKeyType(key), certType)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("读取私钥失败: %w", err)
+	}
+
+	var key crypto.Signer
+	var err error
+	switch certType {
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("无效的 -cert-type: %s（可选 ecdsa 或 ed25519）", certType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("保存私钥失败: %w", err)
+	}
+	log.Printf("[TLS] 已生成 %s 私钥 %s", certType, path)
+	return key, nil
+}
+
+// identityKeyType 返回私钥类型名称（与 -cert-type 取值一致）
+func identityKeyType(key crypto.Signer) string {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		return "ecdsa"
+	case ed25519.PrivateKey:
+		return "ed25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+// identityNames 返回证书 SAN：监听主机（非通配地址时）与 -san 列表，去重排序
+func identityNames(listenHost string) []string {
+	var names []string
+	if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) {
+		names = append(names, listenHost)
+	}
+	for _, item := range sanList {
+		for _, name := range strings.Split(item, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// identityCertValid 判断已保存的证书能否继续使用：公钥一致、SAN 相同且未临近到期
+func identityCertValid(cert *x509.Certificate, key crypto.Signer, names []string) bool {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil || !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		return false
+	}
+	if time.Until(cert.NotAfter) < identityRenewBefore {
+		return false
+	}
+	var certNames []string
+	certNames = append(certNames, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		certNames = append(certNames, ip.String())
+	}
+	slices.Sort(certNames)
+	return slices.Equal(certNames, names)
+}
+
+// createIdentityCert 用给定私钥签发自签名证书（随机序列号）
+func createIdentityCert(key crypto.Signer, names []string) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ech-tunnel"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(identityValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if len(names) > 0 {
+		template.Subject.CommonName = names[0]
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+}
+
+// loadPEMCertificate 读取 PEM 文件中的第一张证书
+func loadPEMCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("文件 %s 中没有证书", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// printClientCommand 输出证书公钥指纹与可直接使用的客户端命令
+func printClientCommand(u *url.URL, leaf *x509.Certificate) {
+	pin := spkiFingerprint(leaf)
+	log.Printf("[TLS] 服务端证书公钥指纹 (SPKI SHA-256): %s", pin)
+
+	host := "<服务器地址>"
+	switch {
+	case len(leaf.DNSNames) > 0:
+		host = leaf.DNSNames[0]
+	case len(leaf.IPAddresses) > 0:
+		host = leaf.IPAddresses[0].String()
+	}
+	target := url.URL{Scheme: u.Scheme, Host: net.JoinHostPort(host, u.Port()), Path: u.Path}
+	cmd := fmt.Sprintf("./ech-tunnel -l proxy://127.0.0.1:1080 -f %s -pin %s", target.String(), pin)
+	if token != "" {
+		cmd += " -token <token>"
+	}
+	log.Printf("[TLS] 客户端命令: %s", cmd)
+}
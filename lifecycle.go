@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inheritFDsEnv 平滑重启时传给新进程的监听套接字列表（"tcp:地址,udp:地址"，依次对应文件描述符 3、4…）
+const inheritFDsEnv = "ECH_TUNNEL_FDS"
+
+// readyFDEnv 平滑重启时新进程通知就绪所用管道的文件描述符
+const readyFDEnv = "ECH_TUNNEL_READY_FD"
+
+// handoffReadyTimeout 等待新进程接管全部监听套接字的最长时间
+const handoffReadyTimeout = 30 * time.Second
+
+// managedListener 可在退出时关闭、在平滑重启时交给新进程的监听套接字
+type managedListener struct {
+	key   string                   // 网络类型:监听地址
+	file  func() (*os.File, error) // 复制出的套接字文件
+	close func()                   // 停止接受新连接
+	// handoff 交给新进程后、close 前调用：UDP 套接字由新旧进程同时读取会打乱 QUIC 数据包，旧进程需立即停止读取；
+	// unix 套接字文件由新进程继续使用，关闭时不能删除
+	handoff func()
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   []*managedListener
+
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+	awaiting    map[string]bool // 尚未重新监听的继承套接字，全部完成后通过 readyPipe 通知父进程
+	readyPipe   *os.File
+
+	shuttingDown atomic.Bool
+	activeConns  atomic.Int64 // 客户端模式下正在转发的本地连接
+)
+
+// loadInherited 读取父进程交接的监听套接字与就绪通知管道
+func loadInherited() {
+	inheritOnce.Do(func() {
+		inherited = make(map[string]*os.File)
+		awaiting = make(map[string]bool)
+		if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+			readyPipe = os.NewFile(uintptr(fd), "ready")
+		}
+		os.Unsetenv(readyFDEnv)
+		if list := os.Getenv(inheritFDsEnv); list != "" {
+			for i, k := range strings.Split(list, ",") {
+				inherited[k] = os.NewFile(uintptr(3+i), k)
+				awaiting[k] = true
+			}
+		}
+		os.Unsetenv(inheritFDsEnv)
+	})
+}
+
+// inheritedFile 取出父进程交接的监听套接字（没有时返回 nil）
+func inheritedFile(key string) *os.File {
+	loadInherited()
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	f := inherited[key]
+	delete(inherited, key)
+	return f
+}
+
+// listenInherited 监听 TCP 地址；由平滑重启启动时直接使用父进程交接的套接字
+func listenInherited(addr string) (net.Listener, error) {
+	key := "tcp:" + addr
+	var ln net.Listener
+	if f := inheritedFile(key); f != nil {
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("使用继承的监听套接字 %s 失败: %v", addr, err)
+		}
+		log.Printf("已继承监听套接字 %s", addr)
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	m := &managedListener{key: key, close: func() { _ = ln.Close() }}
+	if fl, ok := ln.(interface{ File() (*os.File, error) }); ok {
+		m.file = fl.File
+	}
+	registerListener(m)
+	return ln, nil
+}
+
+// listenUnix 监听 unix 套接字并设置文件权限；由平滑重启启动时直接使用父进程交接的套接字，
+// 否则先清理上次运行遗留的套接字文件
+func listenUnix(path string, mode os.FileMode) (*net.UnixListener, error) {
+	key := "unix:" + path
+	var ln *net.UnixListener
+	if f := inheritedFile(key); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("使用继承的监听套接字 %s 失败: %v", path, err)
+		}
+		var ok bool
+		if ln, ok = l.(*net.UnixListener); !ok {
+			l.Close()
+			return nil, fmt.Errorf("%s 不是 unix 套接字", path)
+		}
+		// 继承的套接字默认关闭时不删除文件，正常退出时仍应删除
+		ln.SetUnlinkOnClose(true)
+		log.Printf("已继承监听套接字 %s", path)
+	} else {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		var err error
+		if ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"}); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("设置套接字 %s 的权限失败: %v", path, err)
+	}
+	registerListener(&managedListener{
+		key:     key,
+		file:    ln.File,
+		close:   func() { _ = ln.Close() },
+		handoff: func() { ln.SetUnlinkOnClose(false) },
+	})
+	return ln, nil
+}
+
+// removeStaleSocket 删除上次运行遗留的套接字文件；仍可连接说明有进程在监听，不是套接字的文件不删除
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s 已存在且不是套接字", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("套接字 %s 正被其他进程监听", path)
+	}
+	log.Printf("删除遗留的套接字文件 %s", path)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("删除遗留的套接字文件失败: %v", err)
+	}
+	return nil
+}
+
+// listenPacketInherited 监听 UDP 地址；由平滑重启启动时直接使用父进程交接的套接字
+// 返回的 managedListener 由调用方补充 close/handoff
+func listenPacketInherited(addr string) (*net.UDPConn, *managedListener, error) {
+	key := "udp:" + addr
+	var pc net.PacketConn
+	if f := inheritedFile(key); f != nil {
+		var err error
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("使用继承的 UDP 套接字 %s 失败: %v", addr, err)
+		}
+		log.Printf("已继承 UDP 套接字 %s", addr)
+	} else {
+		var err error
+		if pc, err = net.ListenPacket("udp", addr); err != nil {
+			return nil, nil, err
+		}
+	}
+	udp, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, nil, fmt.Errorf("%s 不是 UDP 套接字", addr)
+	}
+	m := &managedListener{key: key, file: udp.File, close: func() {}}
+	registerListener(m)
+	return udp, m, nil
+}
+
+// registerListener 登记监听套接字；继承的套接字全部重新监听后通知父进程停止接受连接
+func registerListener(m *managedListener) {
+	loadInherited()
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, m)
+	delete(awaiting, m.key)
+	if len(awaiting) == 0 {
+		notifyReady()
+	}
+}
+
+// notifyReady 通知父进程本进程已就绪（调用方持有 listenersMu）
+func notifyReady() {
+	if readyPipe != nil {
+		_, _ = readyPipe.Write([]byte{1})
+		readyPipe.Close()
+		readyPipe = nil
+	}
+}
+
+// trackConn 记录一个客户端本地连接，返回结束时调用的函数
+func trackConn() func() {
+	activeConns.Add(1)
+	var once sync.Once
+	return func() { once.Do(func() { activeConns.Add(-1) }) }
+}
+
+// waitExit 监听已因优雅退出关闭时阻塞，由退出流程结束进程；否则立即返回
+func waitExit() {
+	if shuttingDown.Load() {
+		select {}
+	}
+}
+
+// serveExit 处理服务结束：优雅退出中则等待退出流程，否则视为致命错误
+func serveExit(err error) {
+	waitExit()
+	log.Fatal(err)
+}
+
+// startSignalHandler 处理退出（SIGTERM/SIGINT）与平滑重启（SIGUSR2）信号
+func startSignalHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, append(append([]os.Signal{}, shutdownSignals...), handoffSignals...)...)
+	go func() {
+		for sig := range ch {
+			if shuttingDown.Load() {
+				log.Printf("再次收到 %v，立即退出", sig)
+				os.Exit(1)
+			}
+			if !slices.Contains(handoffSignals, sig) {
+				go shutdown("退出信号", false)
+				continue
+			}
+			if err := handoff(); err != nil {
+				log.Printf("平滑重启失败，继续运行: %v", err)
+				continue
+			}
+			go shutdown("平滑重启", true)
+		}
+	}()
+}
+
+// handoff 以相同参数启动新进程，把全部监听套接字交给它，并等待它重新监听全部套接字；
+// 新进程启动失败或超时未就绪时结束新进程并返回错误，由本进程继续服务
+func handoff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listenersMu.Lock()
+	for _, m := range listeners {
+		if m.file == nil {
+			continue
+		}
+		f, err := m.file()
+		if err != nil {
+			listenersMu.Unlock()
+			return fmt.Errorf("复制监听套接字 %s 失败: %v", m.key, err)
+		}
+		keys = append(keys, m.key)
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("创建就绪通知管道失败: %v", err)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(slices.Clone(files), readyW)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, inheritFDsEnv+"=") && !strings.HasPrefix(kv, readyFDEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, inheritFDsEnv+"="+strings.Join(keys, ","), readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	// 关闭本进程持有的写端，新进程退出时读端随即返回 EOF
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("启动新进程失败: %v", err)
+	}
+	log.Printf("已启动新进程 (pid %d) 并交接 %d 个监听套接字，等待其就绪", cmd.Process.Pid, len(files))
+
+	if err := waitReady(ready, handoffReadyTimeout); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("新进程 (pid %d) 未就绪: %v", cmd.Process.Pid, err)
+	}
+	log.Printf("新进程 (pid %d) 已接管全部监听套接字", cmd.Process.Pid)
+	return nil
+}
+
+// waitReady 等待新进程通过管道通知就绪
+func waitReady(ready *os.File, timeout time.Duration) error {
+	_ = ready.SetReadDeadline(time.Now().Add(timeout))
+	var b [1]byte
+	_, err := ready.Read(b[:])
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return errors.New("新进程在接管监听套接字前退出")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("等待 %v 超时", timeout)
+	}
+	return err
+}
+
+// shutdown 停止接受新连接，等待活动连接结束（最长 -drain-timeout）后退出；handedOff 表示套接字已交给新进程
+func shutdown(reason string, handedOff bool) {
+	if !shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+	log.Printf("收到%s，停止接受新连接，等待活动连接结束（最长 %v）", reason, drainTimeout)
+	listenersMu.Lock()
+	for _, m := range listeners {
+		if handedOff && m.handoff != nil {
+			m.handoff()
+		}
+		m.close()
+	}
+	listenersMu.Unlock()
+
+	deadline := time.Now().Add(drainTimeout)
+	for {
+		_, streams := limits.usage()
+		active := int64(streams) + activeConns.Load()
+		if active == 0 {
+			log.Printf("活动连接已全部结束")
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("等待超时，仍有 %d 个活动连接，强制退出", active)
+			break
+		}
+		// 关闭没有活动流的服务端通道，客户端随即重连到新进程
+		limits.closeIdleChannels()
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if sessionCache != nil && sessionCache.path != "" {
+		if err := sessionCache.save(); err != nil {
+			log.Printf("[TLS] 保存会话缓存失败: %v", err)
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// refuseLimit 超出连接或速率限制（REFUSED 帧原因代码）
+const refuseLimit = "limit"
+
+// tokenBucket 新建流的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 按速率补充令牌后取出一个，令牌不足时返回 false
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter 服务端通道与流的数量、速率限制，同时登记全部通道与流（管理接口查看与关闭）
+type limiter struct {
+	mu             sync.Mutex
+	channels       int
+	streams        int
+	channelsByIP   map[string]int
+	channelsByUser map[string]int
+	streamsByUser  map[string]int
+	buckets        map[string]*tokenBucket // 按用户（无用户名时按 IP）
+	lastSweep      time.Time
+	slots          map[*channelSlot]struct{} // 当前全部通道
+	nextID         uint64
+}
+
+var limits = &limiter{
+	channelsByIP:   make(map[string]int),
+	channelsByUser: make(map[string]int),
+	streamsByUser:  make(map[string]int),
+	buckets:        make(map[string]*tokenBucket),
+	slots:          make(map[*channelSlot]struct{}),
+}
+
+// channelSlot 一个已准入的通道，记录其中的流与累计流量
+type channelSlot struct {
+	l       *limiter
+	id      uint64
+	peer    peerInfo
+	ip      string
+	started time.Time
+	streams map[*streamSlot]struct{} // 受 l.mu 保护
+	closeFn func()                   // 关闭通道，受 l.mu 保护
+	once    sync.Once
+
+	up, down atomic.Int64 // 客户端→目标、目标→客户端的字节数（含已结束的流）
+}
+
+// streamSlot 通道中的一个 TCP/UDP 流
+type streamSlot struct {
+	ch      *channelSlot
+	id      string // WebSocket 连接 ID 或 QUIC 流 ID
+	kind    string // tcp 或 udp
+	target  string
+	started time.Time
+	closeFn func() // 关闭流，受 l.mu 保护
+	once    sync.Once
+
+	up, down atomic.Int64
+}
+
+// peerIP 返回通道对端的 IP（不含端口）
+func peerIP(peer peerInfo) string {
+	host, _, err := net.SplitHostPort(peer.addr)
+	if err != nil {
+		return peer.addr
+	}
+	return host
+}
+
+// acquireChannel 检查全局、每 IP 与每用户的通道数限制，通过时占用一个通道名额
+func (l *limiter) acquireChannel(peer peerInfo) (*channelSlot, error) {
+	ip := peerIP(peer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case maxChannels > 0 && l.channels >= maxChannels:
+		return nil, l.refuse("服务端通道数已达上限 %d", maxChannels)
+	case maxChannelsPerIP > 0 && l.channelsByIP[ip] >= maxChannelsPerIP:
+		return nil, l.refuse("IP %s 的通道数已达上限 %d", ip, maxChannelsPerIP)
+	case maxChannelsPerUser > 0 && peer.user != "" && l.channelsByUser[peer.user] >= maxChannelsPerUser:
+		return nil, l.refuse("用户 %s 的通道数已达上限 %d", peer.user, maxChannelsPerUser)
+	}
+	l.channels++
+	l.channelsByIP[ip]++
+	if peer.user != "" {
+		l.channelsByUser[peer.user]++
+	}
+	l.nextID++
+	s := &channelSlot{l: l, id: l.nextID, peer: peer, ip: ip, started: time.Now(), streams: make(map[*streamSlot]struct{})}
+	l.slots[s] = struct{}{}
+	return s, nil
+}
+
+// setCloser 设置关闭通道的函数（优雅退出时关闭空闲通道）
+func (s *channelSlot) setCloser(fn func()) {
+	s.l.mu.Lock()
+	s.closeFn = fn
+	s.l.mu.Unlock()
+}
+
+// closeIdleChannels 关闭没有活动流的通道
+func (l *limiter) closeIdleChannels() {
+	l.mu.Lock()
+	var idle []func()
+	for s := range l.slots {
+		if len(s.streams) == 0 && s.closeFn != nil {
+			idle = append(idle, s.closeFn)
+			s.closeFn = nil
+		}
+	}
+	l.mu.Unlock()
+	for _, fn := range idle {
+		fn()
+	}
+}
+
+// release 通道结束时归还名额
+func (s *channelSlot) release() {
+	s.once.Do(func() {
+		l := s.l
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.channels--
+		delete(l.slots, s)
+		decCount(l.channelsByIP, s.ip)
+		if s.peer.user != "" {
+			decCount(l.channelsByUser, s.peer.user)
+		}
+	})
+}
+
+// acquireStream 检查新建流的速率与全局、每通道、每用户的并发流数，通过时登记该流
+func (s *channelSlot) acquireStream(id, kind, target string) (*streamSlot, error) {
+	l := s.l
+	user := s.peer.user
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case maxStreams > 0 && l.streams >= maxStreams:
+		return nil, l.refuse("服务端并发流已达上限 %d", maxStreams)
+	case maxStreamsPerChannel > 0 && len(s.streams) >= maxStreamsPerChannel:
+		return nil, l.refuse("通道 %s 的并发流已达上限 %d", s.peer, maxStreamsPerChannel)
+	case maxStreamsPerUser > 0 && user != "" && l.streamsByUser[user] >= maxStreamsPerUser:
+		return nil, l.refuse("用户 %s 的并发流已达上限 %d", user, maxStreamsPerUser)
+	}
+	if streamRate > 0 {
+		key := user
+		if key == "" {
+			key = s.ip
+		}
+		now := time.Now()
+		l.sweepBuckets(now)
+		b := l.buckets[key]
+		if b == nil {
+			b = &tokenBucket{tokens: float64(l.burst()), last: now}
+			l.buckets[key] = b
+		}
+		if !b.take(streamRate, l.burst(), now) {
+			return nil, l.refuse("%s 新建流过快（每秒 %g 个）", key, streamRate)
+		}
+	}
+
+	l.streams++
+	if user != "" {
+		l.streamsByUser[user]++
+	}
+	st := &streamSlot{ch: s, id: id, kind: kind, target: target, started: time.Now()}
+	s.streams[st] = struct{}{}
+	return st, nil
+}
+
+// release 流结束时归还名额
+func (st *streamSlot) release() {
+	st.once.Do(func() {
+		l := st.ch.l
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.streams--
+		delete(st.ch.streams, st)
+		if user := st.ch.peer.user; user != "" {
+			decCount(l.streamsByUser, user)
+		}
+	})
+}
+
+// setCloser 设置关闭流的函数（管理接口强制关闭）
+func (st *streamSlot) setCloser(fn func()) {
+	st.ch.l.mu.Lock()
+	st.closeFn = fn
+	st.ch.l.mu.Unlock()
+}
+
+// addUp 记录客户端发往目标的字节数
+func (st *streamSlot) addUp(n int) {
+	st.up.Add(int64(n))
+	st.ch.up.Add(int64(n))
+}
+
+// addDown 记录目标发往客户端的字节数
+func (st *streamSlot) addDown(n int) {
+	st.down.Add(int64(n))
+	st.ch.down.Add(int64(n))
+}
+
+// countingConn 统计流量的目标连接：读取为目标→客户端，写入为客户端→目标
+type countingConn struct {
+	net.Conn
+	st *streamSlot
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.st.addDown(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.st.addUp(n)
+	return n, err
+}
+
+// burst 令牌桶容量：-stream-burst，未指定时为每秒速率（至少 1）
+func (l *limiter) burst() int {
+	if streamBurst > 0 {
+		return streamBurst
+	}
+	return max(1, int(streamRate))
+}
+
+// sweepBuckets 定期清理已补满的令牌桶（调用方持有 l.mu）
+func (l *limiter) sweepBuckets(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.burst()) / streamRate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// refuse 记录一次超限拒绝并返回 REFUSED 原因（调用方持有 l.mu）
+func (l *limiter) refuse(format string, args ...any) error {
+	stats.limitRefused.Add(1)
+	err := &refusalError{code: refuseLimit, reason: fmt.Sprintf(format, args...)}
+	log.Printf("[限制] %s", err.reason)
+	return err
+}
+
+// usage 返回当前通道数与并发流数
+func (l *limiter) usage() (channels, streams int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.channels, l.streams
+}
+
+// decCount 计数减一，归零时删除
+func decCount(m map[string]int, key string) {
+	if m[key] <= 1 {
+		delete(m, key)
+		return
+	}
+	m[key]--
+}
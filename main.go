@@ -4,8 +4,14 @@ import (
 	"flag"
 	"log"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
+// defaultDNSServer 未指定 -dns 时使用的 DoH 服务器
+const defaultDNSServer = "dns.alidns.com/dns-query"
+
 // 全局参数
 var (
 	listenAddr    string
@@ -18,33 +24,192 @@ var (
 	connectionNum int
 
 	// ECH/DNS 参数
-	dnsServer string // -dns
-	echDomain string // -ech
+	dnsServers stringList // -dns（可重复）
+	echDomain  string     // -ech
+	echKeyFile string     // -ech-key（服务端）
+
+	// 客户端证书校验参数
+	caFile  string     // -ca
+	pinList stringList // -pin（可重复）
+
+	// 双向 TLS 参数
+	clientCAFile   string // -client-ca（服务端）
+	clientAuthMode string // -client-auth（服务端）
+	clientCertFile string // -client-cert（客户端）
+	clientKeyFile  string // -client-key（客户端）
+
+	// 上游代理参数
+	upstreamProxyAddr string // -upstream-proxy（客户端）
+
+	// WebSocket 握手参数
+	headerList     stringList // -header（客户端，可重复）
+	hostOverride   string     // -host（客户端）
+	origin         string     // -origin（客户端）
+	requireHeaders stringList // -require-header（服务端，可重复）
+	usersPath      string     // -users（服务端）
+	fallbackTarget string     // -fallback（服务端）
+
+	// 真实客户端地址（服务端）
+	proxyProtocol    bool   // -proxy-protocol
+	trustedProxyList string // -trusted-proxies
+	realIPHeader     string // -real-ip-header
+	unixSocketMode   string // -unix-mode
+
+	// 目标访问策略（服务端）
+	egressAllow        stringList // -egress-allow（可重复）
+	egressDeny         stringList // -egress-deny（可重复）
+	egressAllowPrivate bool       // -egress-allow-private
+	egressOutbound     string     // -egress-outbound
+	egressRoutes       stringList // -egress-route（可重复）
+
+	// 目标域名解析（服务端）
+	targetDNS    stringList // -target-dns（可重复）
+	targetHosts  stringList // -target-host（可重复）
+	targetPrefer string     // -target-prefer
+
+	// 连接与速率限制（服务端，0 表示不限制）
+	maxChannels          int     // -max-channels
+	maxChannelsPerIP     int     // -max-channels-per-ip
+	maxChannelsPerUser   int     // -max-channels-per-user
+	maxStreams           int     // -max-streams
+	maxStreamsPerChannel int     // -max-streams-per-channel
+	maxStreamsPerUser    int     // -max-streams-per-user
+	streamRate           float64 // -stream-rate
+	streamBurst          int     // -stream-burst
+
+	// 签名认证参数
+	authID      string        // -auth-id（客户端）
+	authSecret  string        // -auth-secret
+	authKeyFile string        // -auth-key（客户端）
+	authSkew    time.Duration // -auth-skew（服务端）
+
+	// 传输参数
+	useH2 bool // -h2
+
+	// 自签名证书参数（服务端）
+	stateDir string     // -state-dir
+	certType string     // -cert-type
+	sanList  stringList // -san（可重复）
+
+	// ACME 参数（服务端）
+	acmeDomains   stringList // -acme-domain（可重复）
+	acmeDirectory string     // -acme-directory
+	acmeEmail     string     // -acme-email
+	acmeCacheDir  string     // -acme-cache
+	acmeCAFile    string     // -acme-ca
+	acmeHTTPAddr  string     // -acme-http
+
+	// 会话复用与统计参数
+	sessionCacheFile string        // -session-cache（客户端）
+	statsInterval    time.Duration // -stats-interval
+	drainTimeout     time.Duration // -drain-timeout
+	adminAddr        string        // -admin（服务端）
 
 	// 多通道连接池
 	echPool *ECHPool
 )
 
 func init() {
-	flag.StringVar(&listenAddr, "l", "", "监听地址 (tcp://监听1/目标1,监听2/目标2,... 或 ws://ip:port/path 或 wss://ip:port/path 或 proxy://[user:pass@]ip:port)")
-	flag.StringVar(&forwardAddr, "f", "", "服务地址 (格式: wss://host:port/path)")
-	flag.StringVar(&ipAddr, "ip", "", "指定解析的IP地址（仅客户端：将 wss 主机名定向到该 IP 连接）")
-	flag.StringVar(&certFile, "cert", "", "TLS证书文件路径（默认:自动生成，仅服务端）")
-	flag.StringVar(&keyFile, "key", "", "TLS密钥文件路径（默认:自动生成，仅服务端）")
+	flag.StringVar(&listenAddr, "l", "", "监听地址 (tcp://监听1/目标1,监听2/目标2,... 或 ws://ip:port/path 或 wss://ip:port/path 或 ws+unix:///套接字路径:/path 或 tls://ip:port 或 quic://ip:port 或 proxy://[user:pass@]ip:port)")
+	flag.StringVar(&forwardAddr, "f", "", "服务地址 (格式: wss://host:port/path、tls://host:port 或 quic://host:port)")
+	flag.StringVar(&ipAddr, "ip", "", "指定连接的IP地址（仅客户端：逗号分隔的 IP 或 CIDR，各通道分散连接；未指定时通过 DoH 解析 -f 主机名）")
+	flag.StringVar(&certFile, "cert", "", "TLS证书文件路径，多个证书用逗号分隔并按 SNI 选择（默认:自动生成，仅服务端）")
+	flag.StringVar(&keyFile, "key", "", "TLS密钥文件路径，与 -cert 按顺序对应（默认:自动生成，仅服务端）")
 	flag.StringVar(&token, "token", "", "身份验证令牌（WebSocket Subprotocol）")
 	flag.StringVar(&cidrs, "cidr", "0.0.0.0/0,::/0", "允许的来源 IP 范围 (CIDR),多个范围用逗号分隔")
-	flag.StringVar(&dnsServer, "dns", "dns.alidns.com/dns-query", "查询 ECH 公钥所用的 DoH 服务器地址")
+	flag.Var(&dnsServers, "dns", "查询 ECH 公钥及解析服务端地址所用的 DoH 服务器，可重复指定按顺序尝试；可用 #IP1,IP2 附加引导地址 (默认 "+defaultDNSServer+")")
 	flag.StringVar(&echDomain, "ech", "cloudflare-ech.com", "用于查询 ECH 公钥的域名")
+	flag.StringVar(&echKeyFile, "ech-key", "", "服务端 ECH 密钥文件（PEM: PRIVATE KEY + ECHCONFIG），由本服务端直接终结 ECH 时使用（仅服务端）")
 	flag.IntVar(&connectionNum, "n", 3, "WebSocket连接数量")
+	flag.BoolVar(&useH2, "h2", false, "通过 HTTP/2 extended CONNECT (RFC 8441) 在单条连接上承载所有通道，失败时回退 HTTP/1.1 升级（客户端与服务端均需开启）")
+	flag.StringVar(&caFile, "ca", "", "额外信任的 CA 证书文件（PEM，仅客户端）")
+	flag.Var(&pinList, "pin", "服务端证书公钥固定 sha256/<base64>，可重复指定以支持轮换（仅客户端）")
+	flag.Var(&acmeDomains, "acme-domain", "通过 ACME 自动签发并续期证书的域名，可重复指定（仅 wss 服务端）")
+	flag.StringVar(&acmeDirectory, "acme-directory", acme.LetsEncryptURL, "ACME 目录地址（可指向 Pebble 等本地测试服务）")
+	flag.StringVar(&acmeEmail, "acme-email", "", "ACME 账户联系邮箱")
+	flag.StringVar(&acmeCacheDir, "acme-cache", "acme-cache", "ACME 账户密钥与证书的保存目录")
+	flag.StringVar(&acmeCAFile, "acme-ca", "", "访问 ACME 目录时额外信任的 CA 文件（如 Pebble 的 pebble.minica.pem）")
+	flag.StringVar(&acmeHTTPAddr, "acme-http", "", "额外的 HTTP-01 挑战监听地址（如 :80），监听端口本身也会应答明文 HTTP 挑战")
+	flag.StringVar(&clientCAFile, "client-ca", "", "校验客户端证书所用的 CA 文件，启用双向 TLS（仅服务端）")
+	flag.StringVar(&clientAuthMode, "client-auth", "require", "双向 TLS 模式: require（必须提供证书）或 verify（提供时校验）（仅服务端）")
+	flag.StringVar(&clientCertFile, "client-cert", "", "双向 TLS 客户端证书文件（仅客户端）")
+	flag.StringVar(&clientKeyFile, "client-key", "", "双向 TLS 客户端私钥文件（仅客户端）")
+	flag.Var(&headerList, "header", "WebSocket 握手附加的请求头 \"K: V\"，可重复指定（仅客户端）")
+	flag.StringVar(&hostOverride, "host", "", "覆盖握手请求的 Host 头，TLS SNI 不受影响（仅客户端）")
+	flag.StringVar(&origin, "origin", "", "握手请求的 Origin 头（仅客户端）")
+	flag.StringVar(&usersPath, "users", "", "用户文件（JSON 或 .yaml/.yml），每个用户独立令牌，可禁用或设置过期时间，文件变化或 SIGHUP 时重新加载（仅服务端）")
+	flag.Var(&egressAllow, "egress-allow", "允许访问的目标规则，可重复或逗号分隔：*、IP、CIDR、域名、*.域名，可加 :端口 或 :起-止（指定后只允许匹配的目标，仅服务端）")
+	flag.Var(&egressDeny, "egress-deny", "拒绝访问的目标规则，格式同 -egress-allow，优先于允许规则（仅服务端）")
+	flag.BoolVar(&egressAllowPrivate, "egress-allow-private", false, "允许访问内网、回环与链路本地地址（默认拒绝，仅服务端）")
+	flag.StringVar(&authID, "auth-id", "", "签名认证的客户端 ID（对应服务端用户名），设置后每次握手以时间戳与 nonce 签名代替静态令牌（仅客户端）")
+	flag.StringVar(&authSecret, "auth-secret", "", "签名认证的 HMAC 共享密钥（客户端用于签名；服务端用于验证不在用户文件中的客户端）")
+	flag.StringVar(&authKeyFile, "auth-key", "", "签名认证的 Ed25519 私钥文件，不存在时自动生成并输出公钥（仅客户端）")
+	flag.DurationVar(&authSkew, "auth-skew", time.Minute, "签名认证允许的时钟偏差（仅服务端）")
+	flag.StringVar(&egressOutbound, "egress-outbound", "", "默认出站：direct 或 socks5://、http:// 上游代理，可附加 ?bind=<源IP或网卡>&prefer=ipv4|ipv6&timeout=10s（仅服务端）")
+	flag.Var(&egressRoutes, "egress-route", "出站路由 \"<规则,...>=<出站>\"，规则格式同 -egress-allow，匹配的目标使用该出站，可重复指定（仅服务端）")
+	flag.Var(&targetDNS, "target-dns", "解析隧道目标域名的 DNS 服务器：https://host/path、tls://host[:853][#证书名] 或 [udp://]host[:53]，可重复指定按顺序尝试（默认使用系统解析器，仅服务端）")
+	flag.Var(&targetHosts, "target-host", "目标域名的静态解析 \"域名=IP[,IP]\"，可重复指定（仅服务端）")
+	flag.StringVar(&targetPrefer, "target-prefer", "", "目标域名解析结果的地址族偏好: ipv4、ipv6、ipv4-only 或 ipv6-only（仅服务端）")
+	flag.StringVar(&fallbackTarget, "fallback", "", "伪装站点：静态文件目录或 http(s):// 上游地址，非隧道请求、其他路径及未通过认证的请求都由它响应（仅 WebSocket 服务端）")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "监听端接受 PROXY protocol v1/v2 头部，以其中的客户端地址作为来源（指定 -trusted-proxies 时只要求可信代理发送，仅 ws/wss/tls 服务端）")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "可信代理的 IP 或 CIDR，逗号分隔；来自这些地址的请求按 -real-ip-header 取客户端 IP（仅服务端）")
+	flag.StringVar(&realIPHeader, "real-ip-header", "X-Forwarded-For", "可信代理设置客户端 IP 的头部，如 X-Forwarded-For、X-Real-IP、CF-Connecting-IP；只读取这一个头部（仅服务端）")
+	flag.StringVar(&unixSocketMode, "unix-mode", "0660", "ws+unix 监听的套接字文件权限（八进制，仅服务端）")
+	flag.IntVar(&maxChannels, "max-channels", 0, "服务端同时建立的通道总数上限（0 表示不限制）")
+	flag.IntVar(&maxChannelsPerIP, "max-channels-per-ip", 0, "每个客户端 IP 的通道数上限（0 表示不限制）")
+	flag.IntVar(&maxChannelsPerUser, "max-channels-per-user", 0, "每个用户的通道数上限（0 表示不限制）")
+	flag.IntVar(&maxStreams, "max-streams", 0, "服务端并发 TCP/UDP 流总数上限（0 表示不限制）")
+	flag.IntVar(&maxStreamsPerChannel, "max-streams-per-channel", 0, "每个通道的并发流上限（0 表示不限制）")
+	flag.IntVar(&maxStreamsPerUser, "max-streams-per-user", 0, "每个用户的并发流上限（0 表示不限制）")
+	flag.Float64Var(&streamRate, "stream-rate", 0, "每个用户（无用户名时按 IP）每秒新建流数（令牌桶，0 表示不限制）")
+	flag.IntVar(&streamBurst, "stream-burst", 0, "新建流令牌桶容量（默认等于 -stream-rate）")
+	flag.Var(&requireHeaders, "require-header", "要求握手请求携带的头部 \"K: V\"（仅写 K 表示必须存在），可重复指定（仅服务端）")
+	flag.StringVar(&stateDir, "state-dir", "ech-tunnel-state", "服务端状态目录（保存自签名证书与私钥，重启后复用）")
+	flag.StringVar(&certType, "cert-type", "ecdsa", "自签名证书密钥类型: ecdsa (P-256) 或 ed25519")
+	flag.Var(&sanList, "san", "自签名证书额外的 SAN（域名或 IP，逗号分隔或重复指定；监听主机自动包含）")
+	flag.StringVar(&sessionCacheFile, "session-cache", "", "TLS 会话缓存持久化文件，重启后仍可复用会话（仅客户端，文件含会话密钥，权限 0600）")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "收到 SIGTERM/SIGINT 或 SIGUSR2 平滑重启时等待活动连接结束的最长时间")
+	flag.StringVar(&adminAddr, "admin", "", "本机管理接口地址：回环地址如 127.0.0.1:9090 或 unix:/路径，可查看通道与流并强制关闭（仅服务端）")
+	flag.DurationVar(&statsInterval, "stats-interval", 5*time.Minute, "统计信息输出间隔（0 表示关闭）")
+	flag.StringVar(&upstreamProxyAddr, "upstream-proxy", "", "经上游代理连接服务端及 DoH (http://[user:pass@]host:port 或 socks5://...)，未指定时读取 HTTPS_PROXY 并遵循 NO_PROXY（仅客户端）")
 }
 
 func main() {
 	flag.Parse()
+	if len(dnsServers) == 0 {
+		dnsServers = stringList{defaultDNSServer}
+	}
+	startStatsReporter()
+	startSignalHandler()
+	if adminAddr != "" {
+		if err := startAdminServer(adminAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if authID != "" {
+		if authSecret == "" && authKeyFile == "" {
+			log.Fatal("-auth-id 需配合 -auth-secret 或 -auth-key 使用")
+		}
+		if authKeyFile != "" {
+			// 启动时加载（或生成）私钥并输出公钥
+			if _, err := loadAuthKey(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-	if strings.HasPrefix(listenAddr, "ws://") || strings.HasPrefix(listenAddr, "wss://") {
+	if strings.HasPrefix(listenAddr, "ws://") || strings.HasPrefix(listenAddr, "wss://") || strings.HasPrefix(listenAddr, "ws+unix://") {
 		runWebSocketServer(listenAddr)
 		return
 	}
+	if strings.HasPrefix(listenAddr, "tls://") {
+		runRawTLSServer(listenAddr)
+		return
+	}
+	if strings.HasPrefix(listenAddr, "quic://") {
+		runQUICServer(listenAddr)
+		return
+	}
 	if strings.HasPrefix(listenAddr, "tcp://") {
 		// 客户端模式：预先获取 ECH 公钥（失败则直接退出，严格禁止回退）
 		if err := prepareECH(); err != nil {
@@ -62,5 +227,5 @@ func main() {
 		return
 	}
 
-	log.Fatal("监听地址格式错误，请使用 ws://, wss://, tcp:// 或 proxy:// 前缀")
+	log.Fatal("监听地址格式错误，请使用 ws://, wss://, ws+unix://, tls://, quic://, tcp:// 或 proxy:// 前缀")
 }
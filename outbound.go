@@ -0,0 +1,321 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outbound 服务端连接目标的出站方式：直连（可指定源地址或网卡、地址族偏好、超时）或经上游 SOCKS5/HTTP 代理
+type outbound struct {
+	name    string     // 出站配置（隐去密码），用于日志
+	bindIP  netip.Addr // 源地址
+	iface   string     // 源网卡，使用其上与目标同族的地址
+	prefer  string     // ipv4、ipv6 或空（按解析顺序）
+	timeout time.Duration
+	proxy   *upstreamProxy
+}
+
+// directOutbound 未配置 -egress-outbound 时的默认出站
+var directOutbound = &outbound{name: "direct", timeout: dialTimeout}
+
+// parseOutbound 解析出站配置：direct、socks5://[user:pass@]host:port 或 http://[user:pass@]host:port，
+// 均可附加 ?bind=<IP或网卡>&prefer=ipv4|ipv6&timeout=<时长>
+func parseOutbound(spec string) (*outbound, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("无效的出站配置 %s: %v", spec, err)
+	}
+	o := &outbound{name: u.Redacted(), timeout: dialTimeout}
+	q := u.Query()
+	for k := range q {
+		if k != "bind" && k != "prefer" && k != "timeout" {
+			return nil, fmt.Errorf("出站配置 %s 含未知参数 %s", o.name, k)
+		}
+	}
+	if bind := q.Get("bind"); bind != "" {
+		if ip, err := netip.ParseAddr(bind); err == nil {
+			o.bindIP = ip.Unmap()
+		} else if _, err := net.InterfaceByName(bind); err == nil {
+			o.iface = bind
+		} else {
+			return nil, fmt.Errorf("出站配置 %s 的 bind 既不是 IP 也不是网卡: %s", o.name, bind)
+		}
+	}
+	switch o.prefer = q.Get("prefer"); o.prefer {
+	case "", "ipv4", "ipv6":
+	default:
+		return nil, fmt.Errorf("出站配置 %s 的 prefer 应为 ipv4 或 ipv6", o.name)
+	}
+	if t := q.Get("timeout"); t != "" {
+		if o.timeout, err = time.ParseDuration(t); err != nil || o.timeout <= 0 {
+			return nil, fmt.Errorf("出站配置 %s 的 timeout 无效: %s", o.name, t)
+		}
+	}
+
+	switch u.Scheme {
+	case "":
+		if u.Path != "direct" {
+			return nil, fmt.Errorf("不支持的出站配置: %s（应为 direct、socks5:// 或 http://）", o.name)
+		}
+	case "http", "socks5", "socks5h":
+		u.RawQuery = ""
+		if o.proxy, err = parseUpstreamProxy(u.String()); err != nil {
+			return nil, err
+		}
+		// 连接代理服务器本身时同样使用出站的源地址与地址族偏好
+		o.proxy.dial = o.dialHost
+	default:
+		return nil, fmt.Errorf("不支持的出站配置: %s（应为 direct、socks5:// 或 http://）", o.name)
+	}
+	return o, nil
+}
+
+// sourceAddr 返回连接 ip 时使用的源地址，未指定源地址或网卡时返回无效地址
+func (o *outbound) sourceAddr(ip netip.Addr) (netip.Addr, error) {
+	switch {
+	case o.bindIP.IsValid():
+		if o.bindIP.Is4() != ip.Is4() {
+			return netip.Addr{}, fmt.Errorf("源地址 %s 无法连接 %s（地址族不同）", o.bindIP, ip)
+		}
+		return o.bindIP, nil
+	case o.iface != "":
+		ifi, err := net.InterfaceByName(o.iface)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("网卡 %s 不可用: %v", o.iface, err)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("读取网卡 %s 的地址失败: %v", o.iface, err)
+		}
+		for _, a := range addrs {
+			p, err := netip.ParsePrefix(a.String())
+			if err != nil {
+				continue
+			}
+			if src := p.Addr().Unmap(); src.Is4() == ip.Is4() && !src.IsLinkLocalUnicast() {
+				return src, nil
+			}
+		}
+		return netip.Addr{}, fmt.Errorf("网卡 %s 没有可用于连接 %s 的地址", o.iface, ip)
+	}
+	return netip.Addr{}, nil
+}
+
+// order 按地址族偏好排序目标地址，同族内保持解析顺序
+func (o *outbound) order(addrs []netip.AddrPort) []netip.AddrPort {
+	if o.prefer == "" {
+		return addrs
+	}
+	rank := func(a netip.AddrPort) int {
+		if a.Addr().Is4() == (o.prefer == "ipv4") {
+			return 0
+		}
+		return 1
+	}
+	sorted := slices.Clone(addrs)
+	slices.SortStableFunc(sorted, func(a, b netip.AddrPort) int { return cmp.Compare(rank(a), rank(b)) })
+	return sorted
+}
+
+// dial 依次连接目标地址，直到成功
+func (o *outbound) dial(ctx context.Context, addrs []netip.AddrPort) (net.Conn, error) {
+	var lastErr error
+	for _, addr := range o.order(addrs) {
+		var conn net.Conn
+		var err error
+		attemptCtx, cancel := context.WithTimeout(ctx, o.timeout)
+		if o.proxy != nil {
+			conn, err = o.proxy.DialContext(attemptCtx, "tcp", addr.String())
+		} else {
+			conn, err = o.dialDirect(attemptCtx, addr)
+		}
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialDirect 从出站的源地址直接连接 addr
+func (o *outbound) dialDirect(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	src, err := o.sourceAddr(addr.Addr())
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if src.IsValid() {
+		d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+	}
+	return d.DialContext(ctx, "tcp", addr.String())
+}
+
+// dialHost 连接上游代理服务器（address 可为域名）
+func (o *outbound) dialHost(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if ips, err = lookupTarget(ctx, host); err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+	}
+	var lastErr error
+	for _, addr := range o.order(addrs) {
+		conn, err := o.dialDirect(ctx, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// udpSocket 服务端连接 UDP 目标的套接字：直连时为 *net.UDPConn，经 SOCKS5 代理时为 UDP 关联
+type udpSocket interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// listenUDP 为访问 target 创建 UDP 套接字：直连时绑定源地址，经 SOCKS5 代理时建立 UDP ASSOCIATE
+func (o *outbound) listenUDP(ctx context.Context, target netip.AddrPort) (udpSocket, error) {
+	if o.proxy != nil {
+		if o.proxy.scheme != "socks5" {
+			return nil, errors.New("HTTP 上游代理不支持 UDP")
+		}
+		ctx, cancel := context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		return o.proxy.associateUDP(ctx)
+	}
+	src, err := o.sourceAddr(target.Addr())
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if src.IsValid() {
+		laddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// egressRoute 出站路由：目标匹配任一规则时使用指定出站
+type egressRoute struct {
+	rules []egressRule
+	out   *outbound
+}
+
+// parseEgressRoutes 解析出站路由，每项格式为 <规则,规则...>=<出站配置>，规则格式同 -egress-allow
+func parseEgressRoutes(items []string) ([]egressRoute, error) {
+	var routes []egressRoute
+	for _, item := range items {
+		rules, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("无效的出站路由 %s（格式: 规则,...=出站配置）", item)
+		}
+		out, err := parseOutbound(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		route := egressRoute{out: out}
+		for _, s := range strings.Split(rules, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			r, err := parseEgressRule(s)
+			if err != nil {
+				return nil, err
+			}
+			route.rules = append(route.rules, r)
+		}
+		if len(route.rules) == 0 {
+			return nil, fmt.Errorf("出站路由 %s 没有规则", item)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// matchRoute 返回第一个匹配目标的路由出站，没有匹配时返回 nil
+func matchRoute(routes []egressRoute, host string, ip netip.Addr, port int) *outbound {
+	for _, route := range routes {
+		for i := range route.rules {
+			if route.rules[i].match(host, ip, port) {
+				return route.out
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	outboundOnce   sync.Once
+	globalOutbound *outbound
+	globalRoutes   []egressRoute
+	outboundErr    error
+)
+
+// getOutbounds 返回 -egress-outbound 指定的默认出站与 -egress-route 出站路由
+func getOutbounds() (*outbound, []egressRoute, error) {
+	outboundOnce.Do(func() {
+		globalOutbound = directOutbound
+		if egressOutbound != "" {
+			if globalOutbound, outboundErr = parseOutbound(egressOutbound); outboundErr != nil {
+				return
+			}
+			log.Printf("[出站] 默认出站: %s", globalOutbound.name)
+		}
+		globalRoutes, outboundErr = parseEgressRoutes(egressRoutes)
+	})
+	return globalOutbound, globalRoutes, outboundErr
+}
+
+// outboundFor 选择访问目标所用的出站：依次匹配用户路由、全局路由，其次为用户出站、默认出站
+func outboundFor(peer peerInfo, host string, ip netip.Addr, port int) *outbound {
+	var user *userEntry
+	if peer.user != "" {
+		if db, _ := getUserDB(); db != nil {
+			user = db.lookup(peer.user)
+		}
+	}
+	def, routes, _ := getOutbounds()
+	if user != nil {
+		if o := matchRoute(user.routes, host, ip, port); o != nil {
+			return o
+		}
+	}
+	if o := matchRoute(routes, host, ip, port); o != nil {
+		return o
+	}
+	if user != nil && user.outbound != nil {
+		return user.outbound
+	}
+	return def
+}
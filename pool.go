@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -17,9 +18,12 @@ type ECHPool struct {
 	wsServerAddr  string
 	connectionNum int
 
-	wsConns   []*websocket.Conn
+	wsConns   []tunnelConn
 	wsMutexes []sync.Mutex
 
+	// quic:// 服务端地址时使用 QUIC 隧道，不使用 WebSocket 通道
+	quic *quicTunnel
+
 	mu               sync.RWMutex
 	tcpMap           map[string]net.Conn
 	udpMap           map[string]*UDPAssociation
@@ -27,16 +31,17 @@ type ECHPool struct {
 	connInfo         map[string]struct{ targetAddr, firstFrameData string }
 	claimTimes       map[string]map[int]time.Time
 	connected        map[string]chan bool
+	refusals         map[string]*refusalError // 服务端拒绝连接的原因（REFUSED），由 WaitConnectedErr 取走
 	boundByChannel   map[int]string
 	pendingByChannel map[int]string
 }
 
 // NewECHPool 创建新的连接池
 func NewECHPool(wsServerAddr string, n int) *ECHPool {
-	return &ECHPool{
+	p := &ECHPool{
 		wsServerAddr:     wsServerAddr,
 		connectionNum:    n,
-		wsConns:          make([]*websocket.Conn, n),
+		wsConns:          make([]tunnelConn, n),
 		wsMutexes:        make([]sync.Mutex, n),
 		tcpMap:           make(map[string]net.Conn),
 		udpMap:           make(map[string]*UDPAssociation),
@@ -44,13 +49,26 @@ func NewECHPool(wsServerAddr string, n int) *ECHPool {
 		connInfo:         make(map[string]struct{ targetAddr, firstFrameData string }),
 		claimTimes:       make(map[string]map[int]time.Time),
 		connected:        make(map[string]chan bool),
+		refusals:         make(map[string]*refusalError),
 		boundByChannel:   make(map[int]string),
 		pendingByChannel: make(map[int]string),
 	}
+	if strings.HasPrefix(wsServerAddr, "quic://") {
+		t, err := newQUICTunnel(wsServerAddr)
+		if err != nil {
+			log.Fatalf("[客户端] %v", err)
+		}
+		p.quic = t
+	}
+	return p
 }
 
 // Start 启动连接池的所有连接
 func (p *ECHPool) Start() {
+	if p.quic != nil {
+		go p.quicLoop()
+		return
+	}
 	for i := 0; i < p.connectionNum; i++ {
 		go p.dialOnce(i)
 	}
@@ -59,7 +77,7 @@ func (p *ECHPool) Start() {
 // dialOnce 为指定通道建立连接
 func (p *ECHPool) dialOnce(index int) {
 	for {
-		wsConn, err := dialWebSocketWithECH(p.wsServerAddr, 2)
+		wsConn, err := dialTunnel(p.wsServerAddr, index, 2)
 		if err != nil {
 			log.Printf("[客户端] 通道 %d WebSocket(ECH) 连接失败: %v，2秒后重试", index, err)
 			time.Sleep(2 * time.Second)
@@ -85,6 +103,11 @@ func (p *ECHPool) RegisterAndClaim(connID, target, firstFrame string, tcpConn ne
 	}
 	p.mu.Unlock()
 
+	if p.quic != nil {
+		go p.quicOpenTCP(connID, target, firstFrame, tcpConn)
+		return
+	}
+
 	for i, ws := range p.wsConns {
 		if ws == nil {
 			continue
@@ -113,8 +136,11 @@ func (p *ECHPool) RegisterUDP(connID string, assoc *UDPAssociation) {
 
 // SendUDPConnect 发送UDP连接请求（选择第一个可用通道）
 func (p *ECHPool) SendUDPConnect(connID, target string) error {
+	if p.quic != nil {
+		return p.quicSendUDPConnect(connID, target)
+	}
 	p.mu.RLock()
-	var ws *websocket.Conn
+	var ws tunnelConn
 	var chID int
 	for i, w := range p.wsConns {
 		if w != nil {
@@ -144,9 +170,12 @@ func (p *ECHPool) SendUDPConnect(connID, target string) error {
 
 // SendUDPData 发送UDP数据
 func (p *ECHPool) SendUDPData(connID string, data []byte) error {
+	if p.quic != nil {
+		return p.quicSendUDPData(connID, data)
+	}
 	p.mu.RLock()
 	chID, ok := p.channelMap[connID]
-	var ws *websocket.Conn
+	var ws tunnelConn
 	if ok && chID < len(p.wsConns) {
 		ws = p.wsConns[chID]
 	}
@@ -166,9 +195,12 @@ func (p *ECHPool) SendUDPData(connID string, data []byte) error {
 
 // SendUDPClose 关闭UDP连接
 func (p *ECHPool) SendUDPClose(connID string) error {
+	if p.quic != nil {
+		return p.quicSendUDPClose(connID)
+	}
 	p.mu.RLock()
 	chID, ok := p.channelMap[connID]
-	var ws *websocket.Conn
+	var ws tunnelConn
 	if ok && chID < len(p.wsConns) {
 		ws = p.wsConns[chID]
 	}
@@ -192,24 +224,61 @@ func (p *ECHPool) SendUDPClose(connID string) error {
 	return err
 }
 
-// WaitConnected 等待连接建立
+// WaitConnected 等待连接建立（建立失败时返回 false）
 func (p *ECHPool) WaitConnected(connID string, timeout time.Duration) bool {
+	return p.WaitConnectedErr(connID, timeout) == nil
+}
+
+// errConnectTimeout 等待服务端连接目标超时
+var errConnectTimeout = errors.New("等待服务端连接目标超时")
+
+// WaitConnectedErr 等待连接建立，服务端拒绝时返回 *refusalError
+func (p *ECHPool) WaitConnectedErr(connID string, timeout time.Duration) error {
 	p.mu.RLock()
 	ch := p.connected[connID]
 	p.mu.RUnlock()
 	if ch == nil {
-		return false
+		return errors.New("连接未注册")
 	}
 	select {
-	case <-ch:
-		return true
+	case ok := <-ch:
+		if ok {
+			return nil
+		}
+		p.mu.Lock()
+		r := p.refusals[connID]
+		delete(p.refusals, connID)
+		p.mu.Unlock()
+		if r != nil {
+			return r
+		}
+		return errors.New("服务端无法连接目标")
 	case <-time.After(timeout):
-		return false
+		p.mu.Lock()
+		delete(p.refusals, connID)
+		p.mu.Unlock()
+		return errConnectTimeout
+	}
+}
+
+// refuse 记录连接被拒绝的原因（可为 nil）并通知等待方
+func (p *ECHPool) refuse(connID string, r *refusalError) {
+	p.mu.Lock()
+	if r != nil {
+		p.refusals[connID] = r
+	}
+	ch := p.connected[connID]
+	p.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- false:
+		default:
+		}
 	}
 }
 
 // handleChannel 处理单个通道的消息
-func (p *ECHPool) handleChannel(channelID int, wsConn *websocket.Conn) {
+func (p *ECHPool) handleChannel(channelID int, wsConn tunnelConn) {
 	wsConn.SetPingHandler(func(message string) error {
 		p.wsMutexes[channelID].Lock()
 		err := wsConn.WriteMessage(websocket.PongMessage, []byte(message))
@@ -383,6 +452,10 @@ func (p *ECHPool) handleChannel(channelID int, wsConn *websocket.Conn) {
 					default:
 					}
 				}
+			} else if strings.HasPrefix(data, "REFUSED:") {
+				connID, r := parseRefusal(strings.TrimPrefix(data, "REFUSED:"))
+				log.Printf("[客户端] 服务端拒绝连接 %s: %v", connID, r)
+				p.refuse(connID, r)
 			} else if strings.HasPrefix(data, "ERROR:") {
 				log.Printf("[客户端] 通道 %d 错误: %s", channelID, data)
 			} else if strings.HasPrefix(data, "CLOSE:") {
@@ -405,7 +478,7 @@ func (p *ECHPool) handleChannel(channelID int, wsConn *websocket.Conn) {
 // redialChannel 重连指定通道
 func (p *ECHPool) redialChannel(channelID int) {
 	for {
-		newConn, err := dialWebSocketWithECH(p.wsServerAddr, 2)
+		newConn, err := dialTunnel(p.wsServerAddr, channelID, 2)
 		if err != nil {
 			time.Sleep(2 * time.Second)
 			continue
@@ -419,9 +492,12 @@ func (p *ECHPool) redialChannel(channelID int) {
 
 // SendData 发送TCP数据
 func (p *ECHPool) SendData(connID string, b []byte) error {
+	if p.quic != nil {
+		return p.quicSendData(connID, b)
+	}
 	p.mu.RLock()
 	chID, ok := p.channelMap[connID]
-	var ws *websocket.Conn
+	var ws tunnelConn
 	if ok && chID < len(p.wsConns) {
 		ws = p.wsConns[chID]
 	}
@@ -437,9 +513,12 @@ func (p *ECHPool) SendData(connID string, b []byte) error {
 
 // SendClose 发送关闭连接消息
 func (p *ECHPool) SendClose(connID string) error {
+	if p.quic != nil {
+		return p.quicSendClose(connID)
+	}
 	p.mu.RLock()
 	chID, ok := p.channelMap[connID]
-	var ws *websocket.Conn
+	var ws tunnelConn
 	if ok && chID < len(p.wsConns) {
 		ws = p.wsConns[chID]
 	}
@@ -57,8 +57,8 @@ func runProxyServer(addr, wsServerAddr string) {
 	if err != nil {
 		log.Fatalf("解析 WebSocket 服务端地址失败: %v", err)
 	}
-	if u.Scheme != "wss" {
-		log.Fatalf("[代理] 仅支持 wss://（客户端必须使用 ECH/TLS1.3）")
+	if u.Scheme != "wss" && u.Scheme != "tls" && u.Scheme != "quic" {
+		log.Fatalf("[代理] 仅支持 wss://、tls:// 或 quic://（客户端必须使用 ECH/TLS1.3）")
 	}
 
 	config, err := parseProxyAddr(addr)
@@ -66,7 +66,7 @@ func runProxyServer(addr, wsServerAddr string) {
 		log.Fatalf("解析代理地址失败: %v", err)
 	}
 
-	listener, err := net.Listen("tcp", config.Host)
+	listener, err := listenInherited(config.Host)
 	if err != nil {
 		log.Fatalf("代理监听失败 %s: %v", config.Host, err)
 	}
@@ -83,11 +83,15 @@ func runProxyServer(addr, wsServerAddr string) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			waitExit()
 			log.Printf("接受连接失败: %v", err)
 			continue
 		}
 
-		go handleProxyConnection(conn, config)
+		go func() {
+			defer trackConn()()
+			handleProxyConnection(conn, config)
+		}()
 	}
 }
 
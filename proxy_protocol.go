@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature PROXY protocol v2 头部签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	trustedOnce    sync.Once
+	trustedProxies []netip.Prefix
+	trustedErr     error
+)
+
+// getTrustedProxies 解析 -trusted-proxies（逗号分隔的 IP 或 CIDR）
+func getTrustedProxies() ([]netip.Prefix, error) {
+	trustedOnce.Do(func() {
+		for _, s := range strings.Split(trustedProxyList, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				ip, ipErr := netip.ParseAddr(s)
+				if ipErr != nil {
+					trustedErr = fmt.Errorf("无法解析 -trusted-proxies: %v", err)
+					return
+				}
+				p = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+			}
+			trustedProxies = append(trustedProxies, p.Masked())
+		}
+	})
+	return trustedProxies, trustedErr
+}
+
+// isTrustedProxy 判断对端地址是否属于 -trusted-proxies；经 unix 套接字连接的本机反向代理总是可信
+func isTrustedProxy(addr string) bool {
+	if addr == unixPeer {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	nets, _ := getTrustedProxies()
+	for _, p := range nets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP 从可信代理添加的 -real-ip-header 头部中取客户端 IP，其他转发头部一概忽略（可由客户端伪造后经代理透传）
+// X-Forwarded-For 从右向左跳过可信代理，取第一个不可信的地址（更左侧的条目可由客户端伪造）；
+// 其他头部（如 CF-Connecting-IP、X-Real-IP）应只含一个由代理覆盖设置的 IP
+func forwardedClientIP(h http.Header) string {
+	if !strings.EqualFold(realIPHeader, "X-Forwarded-For") {
+		if ip, err := netip.ParseAddr(strings.TrimSpace(h.Get(realIPHeader))); err == nil {
+			return ip.Unmap().String()
+		}
+		return ""
+	}
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = ip.Unmap().String()
+		if !isTrustedProxy(client) {
+			break
+		}
+	}
+	return client
+}
+
+// realClientAddr 返回请求的真实客户端地址：直连对端为可信代理且携带转发头部时使用头部中的客户端 IP
+func realClientAddr(r *http.Request) string {
+	if !isTrustedProxy(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	if ip := forwardedClientIP(r.Header); ip != "" {
+		return net.JoinHostPort(ip, "0")
+	}
+	if r.RemoteAddr == unixPeer {
+		// 经 unix 套接字连接但未携带转发头部的本机进程（如健康检查）按回环地址处理
+		return "127.0.0.1:0"
+	}
+	return r.RemoteAddr
+}
+
+// listenServer 监听服务端 TCP 地址或 unix:/路径，启用 -proxy-protocol 时读取每个连接的 PROXY protocol 头部
+func listenServer(addr string) (net.Listener, error) {
+	var ln net.Listener
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("无效的 -unix-mode: %s", unixSocketMode)
+		}
+		ul, err := listenUnix(path, os.FileMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		ln = unixPeerListener{ul}
+	} else {
+		var err error
+		if ln, err = listenInherited(addr); err != nil {
+			return nil, err
+		}
+	}
+	if proxyProtocol {
+		log.Printf("已启用 PROXY protocol，监听 %s", addr)
+		return proxyProtocolListener(ln), nil
+	}
+	return ln, nil
+}
+
+// unixPeer 经 unix 套接字连接的对端（本机反向代理）的地址
+const unixPeer = "unix"
+
+// unixPeerListener 将 unix 套接字连接的 RemoteAddr 统一为 unixPeer，使其按可信代理处理转发头部
+type unixPeerListener struct{ net.Listener }
+
+func (l unixPeerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixPeerConn{conn}, nil
+}
+
+type unixPeerConn struct{ net.Conn }
+
+func (unixPeerConn) RemoteAddr() net.Addr { return &net.UnixAddr{Name: unixPeer, Net: "unix"} }
+
+// proxyProtocolListener 在连接建立后读取 PROXY protocol v1/v2 头部，连接的 RemoteAddr 为头部中的客户端地址
+// 指定 -trusted-proxies 时只有来自可信代理的连接需要携带头部，否则所有连接都必须携带
+func proxyProtocolListener(ln net.Listener) net.Listener {
+	l := newChanListener(ln)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				l.closeWithError(err)
+				return
+			}
+			go func() {
+				if nets, _ := getTrustedProxies(); len(nets) > 0 && !isTrustedProxy(conn.RemoteAddr().String()) {
+					l.deliver(conn)
+					return
+				}
+				br := bufio.NewReader(conn)
+				_ = conn.SetReadDeadline(time.Now().Add(helloTimeout))
+				remote, err := readProxyHeader(br)
+				_ = conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					log.Printf("读取 PROXY protocol 头部失败 %s: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				if remote == nil {
+					remote = conn.RemoteAddr()
+				}
+				l.deliver(&proxiedConn{bufferedConn: bufferedConn{Conn: conn, r: br}, remote: remote})
+			}()
+		}
+	}()
+	return l
+}
+
+// proxiedConn 以 PROXY protocol 头部中的客户端地址作为 RemoteAddr 的连接
+type proxiedConn struct {
+	bufferedConn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+// readProxyHeader 读取 PROXY protocol v1 或 v2 头部，返回客户端地址（UNKNOWN/LOCAL 时返回 nil）
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	if first, err := br.Peek(6); err != nil || string(first) != "PROXY " {
+		return nil, errors.New("缺少 PROXY protocol 头部")
+	}
+	return readProxyV1(br)
+}
+
+// readProxyV1 解析文本格式头部：PROXY TCP4|TCP6|UNKNOWN <源地址> <目的地址> <源端口> <目的端口>\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 头部过长或格式无效")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errors.New("v1 头部格式无效")
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("v1 源地址无效: %v", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("v1 源端口无效: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 解析二进制格式头部
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("不支持的 v2 版本 %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	// LOCAL 命令（代理自身的健康检查等）使用连接本身的地址
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("v2 地址长度无效")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("v2 地址长度无效")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	return nil, nil
+}
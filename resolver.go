@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Happy Eyeballs 相关参数（RFC 8305）
+const (
+	happyEyeballsDelay = 250 * time.Millisecond
+	dialTimeout        = 10 * time.Second
+	minResolveTTL      = 30 * time.Second
+	maxResolveTTL      = 10 * time.Minute
+)
+
+// ipTarget -ip 中的单个条目（单个 IP 或 CIDR 网段）
+type ipTarget struct {
+	ip      net.IP
+	network *net.IPNet
+}
+
+// resolvedHost DoH 解析结果缓存
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var (
+	ipTargetsOnce sync.Once
+	ipTargets     []ipTarget
+	ipTargetsErr  error
+
+	resolveMu    sync.Mutex
+	resolveCache = make(map[string]resolvedHost)
+)
+
+// parseIPTargets 解析 -ip 参数（逗号分隔的 IP 或 CIDR）
+func parseIPTargets(s string) ([]ipTarget, error) {
+	var targets []ipTarget
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("无法解析 CIDR %s: %v", item, err)
+			}
+			targets = append(targets, ipTarget{network: network})
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(item, "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("无效的 IP 地址: %s", item)
+		}
+		targets = append(targets, ipTarget{ip: ip})
+	}
+	return targets, nil
+}
+
+// pick 返回条目对应的 IP（CIDR 时随机选取网段内的一个地址）
+func (t ipTarget) pick() net.IP {
+	if t.network == nil {
+		return t.ip
+	}
+	ones, bits := t.network.Mask.Size()
+	ip := make(net.IP, len(t.network.IP))
+	copy(ip, t.network.IP)
+	hostBits := bits - ones
+	if hostBits == 0 {
+		return ip
+	}
+	// 只随机低 64 位，足以在大网段内分散
+	if hostBits > 64 {
+		hostBits = 64
+	}
+	offset := rand.Uint64()
+	if hostBits < 64 {
+		offset &= 1<<uint(hostBits) - 1
+	}
+	// IPv4 网段避开网络地址与广播地址
+	if bits == 32 && hostBits >= 2 {
+		offset = offset%(1<<uint(hostBits)-2) + 1
+	}
+	tail := make([]byte, 8)
+	binary.BigEndian.PutUint64(tail, offset)
+	for i := 0; i < 8 && i < len(ip); i++ {
+		ip[len(ip)-1-i] |= tail[7-i]
+	}
+	return ip
+}
+
+// dialCandidates 返回指定通道拨号时使用的候选 IP
+// 指定 -ip 时各通道轮流分配条目；否则通过 DoH 解析主机名，按通道号轮换顺序
+func dialCandidates(host string, channel int) ([]net.IP, error) {
+	if ipAddr != "" {
+		ipTargetsOnce.Do(func() {
+			ipTargets, ipTargetsErr = parseIPTargets(ipAddr)
+			if ipTargetsErr == nil && len(ipTargets) == 0 {
+				ipTargetsErr = errors.New("-ip 未包含任何地址")
+			}
+		})
+		if ipTargetsErr != nil {
+			return nil, ipTargetsErr
+		}
+		ips := make([]net.IP, 0, len(ipTargets))
+		for i := range ipTargets {
+			ips = append(ips, ipTargets[(channel+i)%len(ipTargets)].pick())
+		}
+		return ips, nil
+	}
+
+	ips, err := resolveHostViaDoH(host)
+	if err != nil {
+		return nil, err
+	}
+	rotated := make([]net.IP, 0, len(ips))
+	for i := range ips {
+		rotated = append(rotated, ips[(channel+i)%len(ips)])
+	}
+	return rotated, nil
+}
+
+// resolveHostViaDoH 通过 DoH 解析主机名（HTTPS 记录的 ipv4hint/ipv6hint 以及 A/AAAA 记录）
+func resolveHostViaDoH(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	resolveMu.Lock()
+	cached, ok := resolveCache[host]
+	resolveMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	type result struct {
+		records []dnsRecord
+		err     error
+	}
+	qtypes := []uint16{typeHTTPS, typeAAAA, typeA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			records, err := queryDoHRecords(host, qtype)
+			results[i] = result{records: records, err: err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var v4, v6 []net.IP
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if ip == nil || seen[ip.String()] {
+			return
+		}
+		seen[ip.String()] = true
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ttl := maxResolveTTL
+	var errs []string
+	for i, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("type %d: %v", qtypes[i], r.err))
+			continue
+		}
+		for _, rr := range r.records {
+			switch {
+			case rr.rrType == typeHTTPS:
+				for _, ip := range parseHTTPSHints(rr.data) {
+					add(ip)
+				}
+			case rr.rrType == typeA && len(rr.data) == net.IPv4len:
+				add(net.IP(rr.data))
+			case rr.rrType == typeAAAA && len(rr.data) == net.IPv6len:
+				add(net.IP(rr.data))
+			default:
+				continue
+			}
+			if d := time.Duration(rr.ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < minResolveTTL {
+		ttl = minResolveTTL
+	}
+
+	// IPv6 与 IPv4 交替排列（RFC 8305 地址排序）
+	var ips []net.IP
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("DoH 解析 %s 失败: %s", host, strings.Join(errs, "; "))
+		}
+		return nil, fmt.Errorf("DoH 解析 %s 未返回任何地址", host)
+	}
+
+	resolveMu.Lock()
+	resolveCache[host] = resolvedHost{ips: ips, expires: time.Now().Add(ttl)}
+	resolveMu.Unlock()
+	log.Printf("[客户端] DoH 解析 %s -> %v（缓存 %v）", host, ips, ttl)
+	return ips, nil
+}
+
+// dialHappyEyeballs 按顺序竞速连接 host 的候选地址（每隔 250ms 启动下一个尝试，先成功者胜出）
+// host 对应上游代理（按主机名判断 NO_PROXY）时每个尝试都经代理建立隧道
+func dialHappyEyeballs(ctx context.Context, network, host string, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("没有可用的候选地址")
+	}
+	proxy, err := upstreamProxyFor(net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next := 0
+	pending := 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			c, err := dialVia(ctx, proxy, network, addr)
+			results <- result{conn: c, err: err}
+		}()
+	}
+	start()
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var errs []string
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭其余仍在进行的尝试
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err.Error())
+			// 当前尝试失败，立即启动下一个
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, fmt.Errorf("所有候选地址连接失败: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionCacheCapacity 会话缓存最多保存的条目数
+	sessionCacheCapacity = 256
+	// sessionCacheSaveInterval 持久化文件的最短写入间隔
+	sessionCacheSaveInterval = 30 * time.Second
+)
+
+// lruSessionCache 所有通道共享的 TLS 会话缓存（LRU），可选持久化到磁盘
+type lruSessionCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+	path     string
+	dirty    bool
+}
+
+// sessionEntry 缓存条目
+type sessionEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+// persistedSession 持久化格式
+type persistedSession struct {
+	Key    string `json:"key"`
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+var (
+	sessionCacheOnce sync.Once
+	sessionCache     *lruSessionCache
+)
+
+// getSessionCache 返回进程内共享的会话缓存（首次调用时按 -session-cache 加载持久化文件）
+func getSessionCache() *lruSessionCache {
+	sessionCacheOnce.Do(func() {
+		sessionCache = &lruSessionCache{
+			capacity: sessionCacheCapacity,
+			ll:       list.New(),
+			items:    make(map[string]*list.Element),
+			path:     sessionCacheFile,
+		}
+		if sessionCache.path != "" {
+			sessionCache.load()
+			go sessionCache.saveLoop()
+		}
+	})
+	return sessionCache
+}
+
+// sessionCacheFor 返回按当前 ECH 配置、信任配置与客户端证书划分命名空间的会话缓存
+// ECH 公钥轮换、-ca 文件内容、-pin 或 -client-cert 变化后旧会话不会被复用（调用前需已执行 loadClientTrust）
+func sessionCacheFor(echList []byte) tls.ClientSessionCache {
+	h := sha256.New()
+	h.Write(echList)
+	h.Write([]byte{0})
+	h.Write(clientCADigest)
+	// 恢复的会话在服务端仍带签发时的客户端证书身份，更换证书后不能复用
+	h.Write([]byte{0})
+	if cert, err := loadClientCertificate(); err == nil && cert != nil {
+		h.Write(cert.Certificate[0])
+	}
+	pins := append([]string(nil), pinList...)
+	sort.Strings(pins)
+	for _, p := range pins {
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	return &namespacedSessionCache{
+		cache:  getSessionCache(),
+		prefix: hex.EncodeToString(h.Sum(nil)[:8]) + "|",
+	}
+}
+
+// namespacedSessionCache 为键加上命名空间前缀
+type namespacedSessionCache struct {
+	cache  *lruSessionCache
+	prefix string
+}
+
+func (c *namespacedSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.prefix + key)
+}
+
+func (c *namespacedSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.prefix+key, cs)
+}
+
+// Get 实现 tls.ClientSessionCache
+func (c *lruSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return elem.Value.(*sessionEntry).state, true
+	}
+	return nil, false
+}
+
+// Put 实现 tls.ClientSessionCache（cs 为 nil 时删除）
+func (c *lruSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty = true
+	if elem, ok := c.items[key]; ok {
+		if cs == nil {
+			c.ll.Remove(elem)
+			delete(c.items, key)
+			return
+		}
+		elem.Value.(*sessionEntry).state = cs
+		c.ll.MoveToFront(elem)
+		return
+	}
+	if cs == nil {
+		return
+	}
+	c.items[key] = c.ll.PushFront(&sessionEntry{key: key, state: cs})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*sessionEntry).key)
+	}
+}
+
+// load 从持久化文件恢复会话
+func (c *lruSessionCache) load() {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[TLS] 读取会话缓存失败: %v", err)
+		}
+		return
+	}
+	var sessions []persistedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		log.Printf("[TLS] 解析会话缓存失败: %v", err)
+		return
+	}
+	loaded := 0
+	// 文件按最近使用在前保存，倒序插入以还原 LRU 顺序
+	for i := len(sessions) - 1; i >= 0; i-- {
+		s := sessions[i]
+		state, err := tls.ParseSessionState(s.State)
+		if err != nil {
+			continue
+		}
+		cs, err := tls.NewResumptionState(s.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.Put(s.Key, cs)
+		loaded++
+	}
+	c.dirty = false
+	log.Printf("[TLS] 已从 %s 恢复 %d 个会话", c.path, loaded)
+}
+
+// saveLoop 定期将有变化的缓存写入磁盘
+func (c *lruSessionCache) saveLoop() {
+	ticker := time.NewTicker(sessionCacheSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.save(); err != nil {
+			log.Printf("[TLS] 保存会话缓存失败: %v", err)
+		}
+	}
+}
+
+// save 写入持久化文件（先写临时文件再重命名，权限 0600）
+func (c *lruSessionCache) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	sessions := make([]persistedSession, 0, c.ll.Len())
+	for elem := c.ll.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*sessionEntry)
+		ticket, state, err := e.state.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		raw, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, persistedSession{Key: e.key, Ticket: ticket, State: raw})
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// recordHandshake 记录一次客户端 TLS 握手及是否复用了会话
+func recordHandshake(cs tls.ConnectionState) {
+	stats.tlsHandshakes.Add(1)
+	if cs.DidResume {
+		stats.tlsResumed.Add(1)
+	}
+}
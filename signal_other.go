@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// reloadSignals 非 Unix 平台没有 SIGHUP，仅依靠文件变化检测重新加载
+var reloadSignals []os.Signal
+
+// shutdownSignals 触发优雅退出的信号
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// handoffSignals 非 Unix 平台不支持平滑重启
+var handoffSignals []os.Signal
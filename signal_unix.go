@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals 触发重新加载证书等配置的信号
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// shutdownSignals 触发优雅退出的信号
+var shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+
+// handoffSignals 触发平滑重启（把监听套接字交给新进程）的信号
+var handoffSignals = []os.Signal{syscall.SIGUSR2}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -263,6 +264,22 @@ func sendSOCKS5ErrorResponse(conn net.Conn, status uint8) {
 	conn.Write(response)
 }
 
+// socks5ReplyFor 将服务端拒绝原因映射为 SOCKS5 应答码
+func socks5ReplyFor(err error) uint8 {
+	var r *refusalError
+	if errors.As(err, &r) {
+		switch r.code {
+		case refusePolicy, refuseLimit:
+			return ConnectionNotAllowed
+		case refuseResolve:
+			return HostUnreachable
+		case refuseConnect:
+			return ConnectionRefused
+		}
+	}
+	return GeneralFailure
+}
+
 // sendSOCKS5SuccessResponse 发送 SOCKS5 成功响应
 func sendSOCKS5SuccessResponse(conn net.Conn) error {
 	// 简单返回成功响应（绑定地址为 0.0.0.0:0）
@@ -285,9 +302,9 @@ func handleSOCKS5Connect(conn net.Conn, target, clientAddr string) error {
 	}
 
 	echPool.RegisterAndClaim(connID, target, first, conn)
-	if !echPool.WaitConnected(connID, 5*time.Second) {
-		sendSOCKS5ErrorResponse(conn, GeneralFailure)
-		return fmt.Errorf("SOCKS5 CONNECT 超时")
+	if err := echPool.WaitConnectedErr(connID, 5*time.Second); err != nil {
+		sendSOCKS5ErrorResponse(conn, socks5ReplyFor(err))
+		return fmt.Errorf("SOCKS5 CONNECT 失败: %v", err)
 	}
 	if err := sendSOCKS5SuccessResponse(conn); err != nil {
 		return fmt.Errorf("发送SOCKS5成功响应失败: %v", err)
@@ -494,8 +511,8 @@ func (assoc *UDPAssociation) sendUDPData(target string, data []byte) error {
 
 		// 等待连接成功
 		go func() {
-			if !assoc.pool.WaitConnected(assoc.connID, 5*time.Second) {
-				log.Printf("[UDP:%s] 连接超时", assoc.connID)
+			if err := assoc.pool.WaitConnectedErr(assoc.connID, 5*time.Second); err != nil {
+				log.Printf("[UDP:%s] 连接失败: %v", assoc.connID, err)
 				assoc.done <- true
 				return
 			}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeStats 运行统计（-stats-interval 周期输出到日志）
+type runtimeStats struct {
+	tlsHandshakes atomic.Int64 // 客户端完成的 TLS 握手
+	tlsResumed    atomic.Int64 // 其中使用会话复用 (PSK) 的握手
+	limitRefused  atomic.Int64 // 服务端因超出限制拒绝的通道与流
+}
+
+var stats runtimeStats
+
+// startStatsReporter 按 -stats-interval 周期输出统计
+func startStatsReporter() {
+	if statsInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if line := stats.summary(); line != "" {
+				log.Printf("[统计] %s", line)
+			}
+		}
+	}()
+}
+
+// summary 返回统计摘要，没有任何数据时返回空
+func (s *runtimeStats) summary() string {
+	var parts []string
+	if total := s.tlsHandshakes.Load(); total > 0 {
+		resumed := s.tlsResumed.Load()
+		parts = append(parts, fmt.Sprintf("TLS 握手 %d 次，会话复用 %d 次 (%.1f%%)",
+			total, resumed, float64(resumed)*100/float64(total)))
+	}
+	channels, streams := limits.usage()
+	if refused := s.limitRefused.Load(); channels > 0 || streams > 0 || refused > 0 {
+		parts = append(parts, fmt.Sprintf("当前通道 %d 个，并发流 %d 个，超限拒绝 %d 次", channels, streams, refused))
+	}
+	return strings.Join(parts, "；")
+}
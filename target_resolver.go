@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsQueryTimeout   = 3 * time.Second
+	maxTargetDNSCache = 4096
+)
+
+// errNXDomain 目标域名不存在
+var errNXDomain = errors.New("域名不存在 (NXDOMAIN)")
+
+// dnsUpstream 服务端解析隧道目标所用的 DNS 服务器
+type dnsUpstream struct {
+	name string
+	doh  *dohServer  // https:// 时使用
+	addr string      // tls:// 与 udp:// 的 host:port
+	tls  *tls.Config // 非空时为 DoT
+}
+
+// parseDNSUpstream 解析 -target-dns 条目：https://host/path[#引导IP]、tls://host[:853][#证书名] 或 [udp://]host[:53]
+func parseDNSUpstream(entry string) (*dnsUpstream, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.HasPrefix(entry, "https://") {
+		s, err := parseDoHServer(entry)
+		if err != nil {
+			return nil, err
+		}
+		return &dnsUpstream{name: entry, doh: s}, nil
+	}
+	u := &dnsUpstream{name: entry}
+	rest, port := strings.TrimPrefix(entry, "udp://"), "53"
+	if strings.HasPrefix(entry, "tls://") {
+		rest, port = strings.TrimPrefix(entry, "tls://"), "853"
+		var serverName string
+		rest, serverName, _ = strings.Cut(rest, "#")
+		u.tls = &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	}
+	host, p, err := net.SplitHostPort(rest)
+	if err != nil {
+		host, p = strings.Trim(rest, "[]"), port
+	}
+	if host == "" || strings.Contains(host, "/") {
+		return nil, fmt.Errorf("无效的 DNS 服务器: %s", entry)
+	}
+	u.addr = net.JoinHostPort(host, p)
+	if u.tls != nil && u.tls.ServerName == "" {
+		u.tls.ServerName = host
+	}
+	return u, nil
+}
+
+// query 向该服务器查询一种记录，返回原始 DNS 响应
+func (u *dnsUpstream) query(ctx context.Context, domain string, qtype uint16) ([]byte, error) {
+	if u.doh != nil {
+		return dohExchange(domain, qtype, u.doh)
+	}
+	msg := buildDNSQuery(domain, qtype)
+	// 随机 ID，防止伪造响应
+	_, _ = rand.Read(msg[:2])
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	if u.tls != nil {
+		d := tls.Dialer{Config: u.tls}
+		conn, err := d.DialContext(ctx, "tcp", u.addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return exchangeDNSStream(ctx, conn, msg)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || buf[0] != msg[0] || buf[1] != msg[1] {
+			continue
+		}
+		// 响应被截断时改用 TCP
+		if buf[2]&0x02 != 0 {
+			tcp, err := d.DialContext(ctx, "tcp", u.addr)
+			if err != nil {
+				return nil, err
+			}
+			defer tcp.Close()
+			return exchangeDNSStream(ctx, tcp, msg)
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeDNSStream 在 TCP/TLS 连接上以两字节长度前缀发送查询并读取响应
+func exchangeDNSStream(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || resp[0] != msg[0] || resp[1] != msg[1] {
+		return nil, errors.New("DNS 响应 ID 不匹配")
+	}
+	return resp, nil
+}
+
+// cachedAddrs 目标域名的解析缓存
+type cachedAddrs struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// targetResolver 服务端解析隧道目标域名：静态映射、TTL 缓存与可配置的上游
+type targetResolver struct {
+	upstreams []*dnsUpstream // 为空时使用系统解析器
+	hosts     map[string][]netip.Addr
+	prefer    string // ipv4、ipv6、ipv4-only、ipv6-only 或空
+
+	mu    sync.Mutex
+	cache map[string]cachedAddrs
+}
+
+var (
+	targetResolverOnce sync.Once
+	targetResolverInst *targetResolver
+	targetResolverErr  error
+)
+
+// getTargetResolver 按 -target-dns、-target-host、-target-prefer 创建服务端解析器
+func getTargetResolver() (*targetResolver, error) {
+	targetResolverOnce.Do(func() {
+		targetResolverInst, targetResolverErr = newTargetResolver(targetDNS, targetHosts, targetPrefer)
+	})
+	return targetResolverInst, targetResolverErr
+}
+
+// newTargetResolver 创建解析器，hosts 每项格式为 <域名>=<IP>[,<IP>...]
+func newTargetResolver(upstreams, hosts []string, prefer string) (*targetResolver, error) {
+	r := &targetResolver{hosts: make(map[string][]netip.Addr), prefer: prefer, cache: make(map[string]cachedAddrs)}
+	switch prefer {
+	case "", "ipv4", "ipv6", "ipv4-only", "ipv6-only":
+	default:
+		return nil, fmt.Errorf("-target-prefer 应为 ipv4、ipv6、ipv4-only 或 ipv6-only: %s", prefer)
+	}
+	for _, entry := range upstreams {
+		for _, s := range strings.Split(entry, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			u, err := parseDNSUpstream(s)
+			if err != nil {
+				return nil, err
+			}
+			r.upstreams = append(r.upstreams, u)
+		}
+	}
+	for _, entry := range hosts {
+		name, list, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("无效的 -target-host（格式: 域名=IP,...）: %s", entry)
+		}
+		for _, s := range strings.Split(list, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("-target-host %s 的地址无效: %v", name, err)
+			}
+			r.hosts[name] = append(r.hosts[name], ip.Unmap())
+		}
+	}
+	if len(r.upstreams) > 0 {
+		names := make([]string, 0, len(r.upstreams))
+		for _, u := range r.upstreams {
+			names = append(names, u.name)
+		}
+		log.Printf("[解析] 目标域名通过 %s 解析", strings.Join(names, ", "))
+	}
+	return r, nil
+}
+
+// lookup 解析目标域名（host 已转为小写且不含末尾的点），返回按偏好排序的地址
+func (r *targetResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return r.order(addrs), nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	c, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.addrs, nil
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var err error
+	if len(r.upstreams) == 0 {
+		addrs, err = r.lookupSystem(ctx, host)
+		ttl = minResolveTTL
+	} else {
+		addrs, ttl, err = r.lookupUpstreams(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs = r.order(addrs)
+
+	r.mu.Lock()
+	if len(r.cache) >= maxTargetDNSCache {
+		for k, v := range r.cache {
+			if now.After(v.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// 仍然过多时清空，避免大量随机域名占用内存
+		if len(r.cache) >= maxTargetDNSCache {
+			clear(r.cache)
+		}
+	}
+	r.cache[host] = cachedAddrs{addrs: addrs, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// lookupSystem 使用系统解析器（没有 TTL，按最短缓存时间缓存）
+func (r *targetResolver) lookupSystem(ctx context.Context, host string) ([]netip.Addr, error) {
+	network := "ip"
+	switch r.prefer {
+	case "ipv4-only":
+		network = "ip4"
+	case "ipv6-only":
+		network = "ip6"
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, errNXDomain
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, err
+}
+
+// lookupUpstreams 并行查询 A 与 AAAA 记录，每种记录依次尝试各上游，返回地址与最短 TTL
+func (r *targetResolver) lookupUpstreams(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	qtypes := []uint16{typeA, typeAAAA}
+	switch r.prefer {
+	case "ipv4-only":
+		qtypes = []uint16{typeA}
+	case "ipv6-only":
+		qtypes = []uint16{typeAAAA}
+	}
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].addrs, results[i].ttl, results[i].err = r.queryUpstreams(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	ttl := maxResolveTTL
+	var errs []error
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if len(res.addrs) > 0 {
+			ttl = min(ttl, res.ttl)
+		}
+	}
+	if len(addrs) == 0 {
+		for _, err := range errs {
+			if errors.Is(err, errNXDomain) {
+				return nil, 0, errNXDomain
+			}
+		}
+		if len(errs) > 0 {
+			return nil, 0, errors.Join(errs...)
+		}
+		return nil, 0, errors.New("没有 A/AAAA 记录")
+	}
+	return addrs, max(ttl, minResolveTTL), nil
+}
+
+// queryUpstreams 依次向各上游查询一种记录，NXDOMAIN 视为确定的结果不再尝试下一个
+func (r *targetResolver) queryUpstreams(ctx context.Context, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	var errs []string
+	for _, u := range r.upstreams {
+		resp, err := u.query(ctx, host, qtype)
+		if err == nil && len(resp) >= 12 && resp[3]&0x0f == 3 {
+			return nil, 0, errNXDomain
+		}
+		var records []dnsRecord
+		if err == nil {
+			records, err = parseDNSAnswers(resp)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", u.name, err))
+			continue
+		}
+		var addrs []netip.Addr
+		ttl := maxResolveTTL
+		for _, rr := range records {
+			if rr.rrType != qtype {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(rr.data); ok {
+				addrs = append(addrs, ip.Unmap())
+				ttl = min(ttl, time.Duration(rr.ttl)*time.Second)
+			}
+		}
+		return addrs, ttl, nil
+	}
+	return nil, 0, errors.New(strings.Join(errs, "; "))
+}
+
+// order 按 -target-prefer 排序，同族内保持原顺序
+func (r *targetResolver) order(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range addrs {
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch r.prefer {
+	case "ipv4-only":
+		return v4
+	case "ipv6-only":
+		return v6
+	case "ipv6":
+		return slices.Concat(v6, v4)
+	case "ipv4":
+		return slices.Concat(v4, v6)
+	}
+	return addrs
+}
+
+// lookupTarget 解析隧道目标（或出站代理）的域名
+func lookupTarget(ctx context.Context, host string) ([]netip.Addr, error) {
+	r, err := getTargetResolver()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.lookup(ctx, strings.ToLower(strings.TrimSuffix(host, ".")))
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("没有可用的地址")
+	}
+	return addrs, err
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
@@ -18,9 +20,9 @@ import (
 
 // buildTLSConfigWithECH 构建带 ECH 的 TLS 配置
 func buildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, error) {
-	roots, err := x509.SystemCertPool()
+	roots, pins, err := loadClientTrust()
 	if err != nil {
-		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
+		return nil, err
 	}
 	tcfg := &tls.Config{
 		MinVersion: tls.VersionTLS13,
@@ -31,6 +33,26 @@ func buildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, erro
 			return errors.New("服务器拒绝 ECH（禁止回退）")
 		},
 		RootCAs: roots,
+		// 所有通道共享会话缓存，重连时使用 PSK 会话复用
+		ClientSessionCache: sessionCacheFor(echList),
+	}
+	cert, err := loadClientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		tcfg.Certificates = []tls.Certificate{*cert}
+	}
+	if len(pins) > 0 {
+		// 启用公钥固定时由 verifyPinnedChain 完成全部证书校验（以支持已固定的自签名证书）
+		tcfg.InsecureSkipVerify = true
+		tcfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if err := verifyPinnedChain(serverName, roots, pins, rawCerts); err != nil {
+				log.Printf("[TLS] %s 证书校验失败: %v", serverName, err)
+				return err
+			}
+			return nil
+		}
 	}
 	return tcfg, nil
 }
@@ -55,8 +77,8 @@ func runTCPClient(listenForwardAddr, wsServerAddr string) {
 	if err != nil {
 		log.Fatalf("[客户端] 无效的 WebSocket 服务端地址: %v", err)
 	}
-	if u.Scheme != "wss" {
-		log.Fatalf("[客户端] 仅支持 wss://（客户端必须使用 ECH/TLS1.3）")
+	if u.Scheme != "wss" && u.Scheme != "tls" && u.Scheme != "quic" {
+		log.Fatalf("[客户端] 仅支持 wss://、tls:// 或 quic://（客户端必须使用 ECH/TLS1.3）")
 	}
 
 	echPool = NewECHPool(wsServerAddr, connectionNum)
@@ -96,7 +118,7 @@ func runTCPClient(listenForwardAddr, wsServerAddr string) {
 
 // startMultiChannelTCPForwarder 启动多通道 TCP 转发器
 func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *ECHPool) {
-	listener, err := net.Listen("tcp", listenAddress)
+	listener, err := listenInherited(listenAddress)
 	if err != nil {
 		log.Fatalf("TCP监听失败 %s: %v", listenAddress, err)
 	}
@@ -106,6 +128,7 @@ func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *EC
 	for {
 		tcpConn, err := listener.Accept()
 		if err != nil {
+			waitExit()
 			if !strings.Contains(err.Error(), "use of closed network connection") {
 				log.Printf("[客户端] 接受TCP连接失败 %s: %v", listenAddress, err)
 			}
@@ -114,6 +137,7 @@ func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *EC
 
 		connID := uuid.New().String()
 		log.Printf("[客户端] 新的TCP连接 %s，连接ID: %s", tcpConn.RemoteAddr(), connID)
+		done := trackConn()
 
 		// 读取第一帧
 		_ = tcpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
@@ -127,9 +151,10 @@ func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *EC
 
 		pool.RegisterAndClaim(connID, targetAddress, first, tcpConn)
 
-		if !pool.WaitConnected(connID, 5*time.Second) {
-			log.Printf("[客户端] 连接 %s 建立超时，关闭", connID)
+		if err := pool.WaitConnectedErr(connID, 5*time.Second); err != nil {
+			log.Printf("[客户端] 连接 %s 建立失败，关闭: %v", connID, err)
 			_ = tcpConn.Close()
+			done()
 			continue
 		}
 
@@ -137,6 +162,7 @@ func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *EC
 			defer func() {
 				_ = pool.SendClose(cID)
 				_ = c.Close()
+				done()
 			}()
 
 			buf := make([]byte, 32768)
@@ -154,13 +180,48 @@ func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *EC
 	}
 }
 
-// dialWebSocketWithECH 建立 WebSocket 连接（带 ECH 重试）
-func dialWebSocketWithECH(wsServerAddr string, maxRetries int) (*websocket.Conn, error) {
+// handshakeHeader 构建 WebSocket 握手请求的自定义头部（-header、-host、-origin）
+func handshakeHeader() (http.Header, error) {
+	header, err := parseHeaderList(headerList)
+	if err != nil {
+		return nil, err
+	}
+	for k := range header {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+			"Sec-Websocket-Extensions", "Sec-Websocket-Protocol":
+			return nil, fmt.Errorf("不允许自定义 WebSocket 握手头部: %s", k)
+		}
+	}
+	// Host 仅影响 HTTP 请求，TLS SNI 仍使用 -f 中的主机名
+	if hostOverride != "" {
+		header.Set("Host", hostOverride)
+	}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	// 签名认证：每次握手生成新的时间戳与 nonce
+	if authID != "" {
+		signed, err := signedAuthHeader()
+		if err != nil {
+			return nil, fmt.Errorf("生成签名认证失败: %v", err)
+		}
+		header.Set(authHeaderName, signed)
+	}
+	return header, nil
+}
+
+// dialWebSocketWithECH 建立 WebSocket 连接（带 ECH 重试），channel 用于在多个候选 IP 间分散通道
+func dialWebSocketWithECH(wsServerAddr string, channel, maxRetries int) (*websocket.Conn, error) {
 	u, err := url.Parse(wsServerAddr)
 	if err != nil {
 		return nil, fmt.Errorf("解析 wsServerAddr 失败: %v", err)
 	}
 	serverName := u.Hostname()
+	header, err := handshakeHeader()
+	if err != nil {
+		return nil, err
+	}
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		echBytes, echErr := getECHList()
@@ -195,20 +256,21 @@ func dialWebSocketWithECH(wsServerAddr string, maxRetries int) (*websocket.Conn,
 			WriteBufferSize:  65536, // 增加写缓冲区到64KB
 		}
 
-		// 如果指定了IP地址，配置自定义拨号器（SNI 仍为 serverName）
-		if ipAddr != "" {
-			dialer.NetDial = func(network, address string) (net.Conn, error) {
-				_, port, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, err
-				}
-				address = net.JoinHostPort(ipAddr, port)
-				return net.DialTimeout(network, address, 10*time.Second)
+		// 自定义拨号器：候选 IP 来自 -ip 或 DoH 解析，不经过系统 DNS（SNI 仍为 serverName）
+		dialer.NetDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
 			}
+			ips, err := dialCandidates(host, channel)
+			if err != nil {
+				return nil, err
+			}
+			return dialHappyEyeballs(ctx, network, host, ips, port)
 		}
 
 		// 连接到WebSocket服务端（必须 wss）
-		wsConn, _, dialErr := dialer.Dial(wsServerAddr, nil)
+		wsConn, _, dialErr := dialer.Dial(wsServerAddr, header)
 		if dialErr != nil {
 			// 检查是否为 ECH 相关错误
 			if strings.Contains(dialErr.Error(), "ECH") || strings.Contains(dialErr.Error(), "ech") {
@@ -225,6 +287,9 @@ func dialWebSocketWithECH(wsServerAddr string, maxRetries int) (*websocket.Conn,
 			return nil, dialErr
 		}
 
+		if tlsConn, ok := wsConn.NetConn().(*tls.Conn); ok {
+			recordHandshake(tlsConn.ConnectionState())
+		}
 		return wsConn, nil
 	}
 
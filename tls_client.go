@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clientCertOnce sync.Once
+	clientCert     *tls.Certificate
+	clientCertErr  error
+
+	clientTrustOnce sync.Once
+	clientRoots     *x509.CertPool
+	clientPins      map[string]bool
+	clientCADigest  []byte // -ca 文件内容的 SHA-256，用于划分会话缓存
+	clientTrustErr  error
+)
+
+// loadClientTrust 加载客户端信任配置：系统根证书 + -ca 指定的证书，以及 -pin 公钥固定
+func loadClientTrust() (*x509.CertPool, map[string]bool, error) {
+	clientTrustOnce.Do(func() {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			if caFile == "" {
+				clientTrustErr = fmt.Errorf("加载系统根证书失败: %w", err)
+				return
+			}
+			log.Printf("[TLS] 加载系统根证书失败，仅信任 -ca 指定的证书: %v", err)
+			roots = x509.NewCertPool()
+		}
+		if caFile != "" {
+			pemData, err := os.ReadFile(caFile)
+			if err != nil {
+				clientTrustErr = fmt.Errorf("读取 CA 文件失败: %w", err)
+				return
+			}
+			if !roots.AppendCertsFromPEM(pemData) {
+				clientTrustErr = fmt.Errorf("CA 文件 %s 中没有有效的 PEM 证书", caFile)
+				return
+			}
+			sum := sha256.Sum256(pemData)
+			clientCADigest = sum[:]
+			log.Printf("[TLS] 已加载自定义 CA: %s", caFile)
+		}
+
+		pins := make(map[string]bool)
+		for _, p := range pinList {
+			pin, err := parsePin(p)
+			if err != nil {
+				clientTrustErr = err
+				return
+			}
+			pins[pin] = true
+		}
+		if len(pins) > 0 {
+			log.Printf("[TLS] 已启用公钥固定，共 %d 个 pin", len(pins))
+		}
+		clientRoots, clientPins = roots, pins
+	})
+	return clientRoots, clientPins, clientTrustErr
+}
+
+// loadClientCertificate 加载 -client-cert/-client-key 指定的客户端证书（用于双向 TLS）
+func loadClientCertificate() (*tls.Certificate, error) {
+	clientCertOnce.Do(func() {
+		if clientCertFile == "" && clientKeyFile == "" {
+			return
+		}
+		if clientCertFile == "" || clientKeyFile == "" {
+			clientCertErr = errors.New("-client-cert 与 -client-key 必须同时指定")
+			return
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			clientCertErr = fmt.Errorf("加载客户端证书失败: %w", err)
+			return
+		}
+		clientCert = &cert
+		log.Printf("[TLS] 已加载客户端证书: %s", clientCertFile)
+	})
+	return clientCert, clientCertErr
+}
+
+// parsePin 解析 sha256/<base64> 形式的公钥固定值，返回规范化后的字符串
+func parsePin(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "sha256/") {
+		return "", fmt.Errorf("无效的 pin %q（格式应为 sha256/<base64>）", s)
+	}
+	encoded := strings.TrimPrefix(s, "sha256/")
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		raw, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("无效的 pin %q（需要 32 字节 SHA-256 的 Base64）", s)
+	}
+	return "sha256/" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// spkiFingerprint 计算证书公钥 (SPKI) 的 SHA-256 指纹，格式与 -pin 一致
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPinnedChain 启用 -pin 时校验服务端证书
+// 信任链有效时要求链上任一证书公钥命中 pin；信任链无效时仅接受公钥已固定的叶子证书（如自签名证书）
+func verifyPinnedChain(serverName string, roots *x509.CertPool, pins map[string]bool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("服务端未提供证书")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("解析服务端证书失败: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+	leafPin := spkiFingerprint(leaf)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, chainErr := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if chainErr == nil {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if pins[spkiFingerprint(cert)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("证书链有效但没有与 -pin 匹配的公钥（叶子证书公钥: %s）", leafPin)
+	}
+
+	if !pins[leafPin] {
+		return fmt.Errorf("证书链校验失败且叶子证书公钥 %s 未被固定: %v", leafPin, chainErr)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("已固定的证书不在有效期内 (%s ~ %s)",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	log.Printf("[TLS] 证书链不受信任 (%v)，但叶子证书公钥已固定，接受连接", chainErr)
+	return nil
+}
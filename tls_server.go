@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// buildServerTLSConfig 构建服务端 TLS 配置（含可选的双向 TLS 客户端证书校验）
+func buildServerTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+	if echKeyFile != "" {
+		keys, err := loadECHKeys(echKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.EncryptedClientHelloKeys = keys
+		log.Printf("已加载 ECH 密钥: %s（%d 个配置）", echKeyFile, len(keys))
+	}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pemData, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取客户端 CA 文件失败: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("客户端 CA 文件 %s 中没有有效的 PEM 证书", clientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch clientAuthMode {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verify":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("无效的 -client-auth: %s（可选 require 或 verify）", clientAuthMode)
+	}
+	log.Printf("已启用双向 TLS（%s），客户端 CA: %s", clientAuthMode, clientCAFile)
+	return tlsConfig, nil
+}
+
+// loadECHKeys 加载服务端 ECH 密钥文件（PEM: PKCS#8 "PRIVATE KEY" + "ECHCONFIG" 即 ECHConfigList）
+func loadECHKeys(path string) ([]tls.EncryptedClientHelloKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 ECH 密钥文件失败: %w", err)
+	}
+	var privateKey, configList []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("解析 ECH 私钥失败: %w", err)
+			}
+			// X25519 解析为 *ecdh.PrivateKey，P-256/P-384/P-521 解析为 *ecdsa.PrivateKey
+			var ecdhKey *ecdh.PrivateKey
+			switch k := key.(type) {
+			case *ecdh.PrivateKey:
+				ecdhKey = k
+			case *ecdsa.PrivateKey:
+				if ecdhKey, err = k.ECDH(); err != nil {
+					return nil, fmt.Errorf("转换 ECH 私钥失败: %w", err)
+				}
+			default:
+				return nil, errors.New("ECH 私钥必须为 X25519 或 NIST 曲线密钥")
+			}
+			privateKey = ecdhKey.Bytes()
+		case "ECHCONFIG":
+			configList = block.Bytes
+		}
+	}
+	if privateKey == nil || configList == nil {
+		return nil, fmt.Errorf("ECH 密钥文件 %s 需同时包含 PRIVATE KEY 与 ECHCONFIG", path)
+	}
+
+	// ECHConfigList: <总长度 u16> { <版本 u16><长度 u16><内容> }...
+	if len(configList) < 2 || int(binary.BigEndian.Uint16(configList)) != len(configList)-2 {
+		return nil, errors.New("无效的 ECHConfigList")
+	}
+	var keys []tls.EncryptedClientHelloKey
+	for rest := configList[2:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, errors.New("无效的 ECHConfigList")
+		}
+		n := 4 + int(binary.BigEndian.Uint16(rest[2:4]))
+		if len(rest) < n {
+			return nil, errors.New("无效的 ECHConfigList")
+		}
+		keys = append(keys, tls.EncryptedClientHelloKey{Config: rest[:n], PrivateKey: privateKey, SendAsRetry: true})
+		rest = rest[n:]
+	}
+	return keys, nil
+}
+
+// certIdentity 返回已校验客户端证书的身份（优先 CN，其次 SAN），未提供证书时返回空
+func certIdentity(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return cert.SerialNumber.String()
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tunnelConn 隧道通道的消息连接抽象
+// *websocket.Conn（HTTP/1.1 升级）、wsStreamConn（HTTP/2 extended CONNECT 流）与 HTTP 流式回退传输均实现该接口
+type tunnelConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetPingHandler(h func(appData string) error)
+	Close() error
+}
+
+// maxWSMessageSize 单条 WebSocket 消息的最大长度
+const maxWSMessageSize = 16 << 20
+
+// tunnelALPN 不经过 HTTP 的传输（tls://、quic://）使用的 ALPN 协议名
+const tunnelALPN = "ech-tunnel"
+
+// helloTimeout 不经过 HTTP 的传输中握手头部交换的超时
+const helloTimeout = 10 * time.Second
+
+// upgradeFailuresBeforeFallback 连续多少次 WebSocket 升级被拒绝后改用 HTTP 流式传输
+const upgradeFailuresBeforeFallback = 3
+
+var (
+	upgradeFailures atomic.Int32
+	streamFallback  atomic.Bool
+)
+
+// dialTunnel 建立单个隧道通道：启用 -h2 时优先使用 HTTP/2 extended CONNECT，失败则回退 HTTP/1.1 升级；
+// 升级请求被多次拒绝（如网络剥离了 Upgrade 头）后改用 HTTP 流式传输
+func dialTunnel(wsServerAddr string, channel, maxRetries int) (tunnelConn, error) {
+	if strings.HasPrefix(wsServerAddr, "tls://") {
+		return dialRawTLS(wsServerAddr, channel, maxRetries)
+	}
+	if streamFallback.Load() {
+		return dialHTTPStream(wsServerAddr)
+	}
+	if useH2 {
+		conn, err := dialH2WebSocket(wsServerAddr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("[客户端] 通道 %d HTTP/2 extended CONNECT 失败，回退 HTTP/1.1 升级: %v", channel, err)
+	}
+	wsConn, err := dialWebSocketWithECH(wsServerAddr, channel, maxRetries)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && upgradeFailures.Add(1) >= upgradeFailuresBeforeFallback {
+			if streamFallback.CompareAndSwap(false, true) {
+				log.Printf("[客户端] WebSocket 升级连续 %d 次被拒绝，改用 HTTP 流式传输", upgradeFailuresBeforeFallback)
+			}
+			return dialHTTPStream(wsServerAddr)
+		}
+		return nil, err
+	}
+	upgradeFailures.Store(0)
+	return wsConn, nil
+}
+
+// dialTLSWithECH 经 DoH 解析/-ip 候选地址竞速拨号并完成 TLS(ECH) 握手
+func dialTLSWithECH(ctx context.Context, network, address string, channel int, tlsCfg *tls.Config) (*tls.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := dialCandidates(host, channel)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := dialHappyEyeballs(ctx, network, host, ips, port)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(rawConn, tlsCfg.Clone())
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	recordHandshake(tlsConn.ConnectionState())
+	return tlsConn, nil
+}
+
+// sendTunnelHello 以 HTTP 头部块格式发送握手头部（token、-header、-host、-origin），等待服务端准入结果
+func sendTunnelHello(w io.Writer, br *bufio.Reader) error {
+	header, err := handshakeHeader()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		header.Set("Sec-WebSocket-Protocol", token)
+	}
+	var buf bytes.Buffer
+	_ = header.Write(&buf)
+	buf.WriteString("\r\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("读取准入结果失败: %v", err)
+	}
+	if status := strings.TrimSpace(line); status != "200" {
+		return fmt.Errorf("服务端拒绝连接（状态 %s）", status)
+	}
+	return nil
+}
+
+// acceptTunnelHello 读取握手头部，复用 WebSocket 的准入检查（来源 IP、Token、请求头部），并写回结果
+func acceptTunnelHello(w io.Writer, br *bufio.Reader, remoteAddr string, cs *tls.ConnectionState, gate *tunnelGate) (peerInfo, *channelSlot, bool) {
+	mime, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		log.Printf("读取握手头部失败 %s: %v", remoteAddr, err)
+		return peerInfo{}, nil, false
+	}
+	r := &http.Request{
+		Method:     http.MethodGet,
+		Header:     http.Header(mime),
+		Host:       mime.Get("Host"),
+		RemoteAddr: remoteAddr,
+		TLS:        cs,
+	}
+	rec := &helloWriter{header: make(http.Header), status: http.StatusOK}
+	peer, ok := gate.authorize(rec, r)
+	var slot *channelSlot
+	if ok {
+		if slot, err = limits.acquireChannel(peer); err != nil {
+			rec.status, ok = http.StatusTooManyRequests, false
+		}
+	}
+	_, _ = fmt.Fprintf(w, "%d\n", rec.status)
+	return peer, slot, ok
+}
+
+// helloWriter 记录准入检查写出的状态码（不经过 HTTP 的传输没有 HTTP 响应）
+type helloWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *helloWriter) Header() http.Header         { return w.header }
+func (w *helloWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *helloWriter) WriteHeader(status int)      { w.status = status }
+
+// wsStreamConn 在任意字节流上实现 RFC 6455 WebSocket 帧（用于 HTTP/2 extended CONNECT 流）
+type wsStreamConn struct {
+	r      *bufio.Reader
+	w      io.Writer
+	flush  func()
+	closer io.Closer
+	client bool // 客户端发出的帧必须加掩码
+
+	wmu         sync.Mutex
+	closed      bool // 已发出关闭帧，受 wmu 保护；此后不再写出（HTTP/2 处理函数返回后写入会 panic）
+	pingHandler func(appData string) error
+	closeOnce   sync.Once
+}
+
+// newWSStreamConn 创建基于字节流的 WebSocket 连接
+func newWSStreamConn(r io.Reader, w io.Writer, flush func(), closer io.Closer, client bool) *wsStreamConn {
+	c := &wsStreamConn{
+		r:      bufio.NewReaderSize(r, 65536),
+		w:      w,
+		flush:  flush,
+		closer: closer,
+		client: client,
+	}
+	c.pingHandler = func(appData string) error {
+		return c.WriteMessage(websocket.PongMessage, []byte(appData))
+	}
+	return c
+}
+
+// SetPingHandler 设置收到 Ping 时的处理函数
+func (c *wsStreamConn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			return c.WriteMessage(websocket.PongMessage, []byte(appData))
+		}
+	}
+	c.pingHandler = h
+}
+
+// ReadMessage 读取一条完整的数据消息（自动处理分片与控制帧）
+func (c *wsStreamConn) ReadMessage() (int, []byte, error) {
+	var (
+		messageType int
+		message     []byte
+	)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case websocket.PingMessage:
+			if err := c.pingHandler(string(payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocket.PongMessage:
+			continue
+		case websocket.CloseMessage:
+			_ = c.writeFrame(websocket.CloseMessage, payload)
+			return 0, nil, io.EOF
+		case websocket.TextMessage, websocket.BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, errors.New("websocket: 未结束的分片消息中出现新消息")
+			}
+			messageType = opcode
+			message = payload
+		case 0: // continuation
+			if messageType == 0 {
+				return 0, nil, errors.New("websocket: 意外的延续帧")
+			}
+			if len(message)+len(payload) > maxWSMessageSize {
+				return 0, nil, errors.New("websocket: 消息过大")
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, fmt.Errorf("websocket: 未知的操作码 %d", opcode)
+		}
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame 读取单个帧
+func (c *wsStreamConn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWSMessageSize {
+		return false, 0, nil, errors.New("websocket: 帧过大")
+	}
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage 以单帧写出一条消息
+func (c *wsStreamConn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(messageType, data)
+}
+
+// writeFrame 写出单个帧（客户端加掩码）
+func (c *wsStreamConn) writeFrame(opcode int, data []byte) error {
+	frame := make([]byte, 0, len(data)+14)
+	frame = append(frame, 0x80|byte(opcode))
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(data); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, data...)
+		for i := range frame[start:] {
+			frame[start+i] ^= maskKey[i%4]
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == websocket.CloseMessage {
+		c.closed = true
+	}
+	if _, err := c.w.Write(frame); err != nil {
+		return err
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+	return nil
+}
+
+// Close 发出关闭帧后关闭底层流，之后的写入返回 net.ErrClosed
+func (c *wsStreamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.writeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		err = c.closer.Close()
+	})
+	return err
+}
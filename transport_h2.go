@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+var (
+	// 所有通道共享的 HTTP/2 Transport（多个通道作为同一连接上的多个流）
+	h2Mu        sync.Mutex
+	h2Transport *http2.Transport
+	h2ECHList   []byte
+)
+
+// getH2Transport 返回与当前 ECH 配置对应的共享 HTTP/2 Transport，ECH 配置变化时重建
+func getH2Transport(serverName string, echBytes []byte) (*http2.Transport, error) {
+	h2Mu.Lock()
+	defer h2Mu.Unlock()
+	if h2Transport != nil && bytes.Equal(h2ECHList, echBytes) {
+		return h2Transport, nil
+	}
+
+	tlsCfg, err := buildTLSConfigWithECH(serverName, echBytes)
+	if err != nil {
+		return nil, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", err)
+	}
+	tlsCfg.NextProtos = []string{"h2"}
+
+	transport := &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+			tlsConn, err := dialTLSWithECH(ctx, network, address, 0, tlsCfg)
+			if err != nil {
+				return nil, err
+			}
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != "h2" {
+				tlsConn.Close()
+				return nil, fmt.Errorf("服务端未协商 h2（ALPN: %q）", p)
+			}
+			return tlsConn, nil
+		},
+	}
+
+	if h2Transport != nil {
+		h2Transport.CloseIdleConnections()
+	}
+	h2Transport = transport
+	h2ECHList = echBytes
+	return transport, nil
+}
+
+// dialH2WebSocket 通过 HTTP/2 extended CONNECT 建立一个 WebSocket 流
+func dialH2WebSocket(wsServerAddr string) (tunnelConn, error) {
+	u, err := url.Parse(wsServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("解析 wsServerAddr 失败: %v", err)
+	}
+	echBytes, err := getECHList()
+	if err != nil {
+		return nil, fmt.Errorf("ECH 配置不可用: %v", err)
+	}
+	transport, err := getH2Transport(u.Hostname(), echBytes)
+	if err != nil {
+		return nil, err
+	}
+	header, err := handshakeHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, target.String(), pr)
+	if err != nil {
+		return nil, err
+	}
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+		header.Del("Host")
+	}
+	req.Header = header
+	req.Header[":protocol"] = []string{"websocket"}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if token != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", token)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		if strings.Contains(err.Error(), "ECH") {
+			log.Printf("[ECH] HTTP/2 连接失败（可能 ECH 公钥已轮换）: %v", err)
+			if refreshErr := refreshECH(); refreshErr != nil {
+				log.Printf("[ECH] 刷新失败: %v", refreshErr)
+			}
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("extended CONNECT 被拒绝: %s", resp.Status)
+	}
+	return newWSStreamConn(resp.Body, pw, nil, multiCloser{pw, resp.Body}, true), nil
+}
+
+// isExtendedConnect 判断是否为 RFC 8441 WebSocket extended CONNECT 请求
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor == 2 &&
+		strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// serveH2WebSocket 在 HTTP/2 流上处理 WebSocket 通道（阻塞直到通道结束）
+func serveH2WebSocket(w http.ResponseWriter, r *http.Request, peer peerInfo, slot *channelSlot) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	// 与 HTTP/1.1 升级一致：仅在客户端自己提供了 -token 时回显，不向以用户令牌或签名认证的客户端泄露共享令牌
+	if token != "" && slices.Contains(websocket.Subprotocols(r), token) {
+		w.Header().Set("Sec-WebSocket-Protocol", token)
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Printf("HTTP/2 WebSocket 响应失败 %s: %v", peer, err)
+		return
+	}
+
+	conn := newWSStreamConn(r.Body, w, func() { _ = rc.Flush() }, r.Body, false)
+	log.Printf("新的 HTTP/2 WebSocket 流来自 %s", peer)
+	handleWebSocket(conn, peer, slot)
+}
+
+// multiCloser 依次关闭多个对象
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var errs []error
+	for _, c := range m {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// HTTP 流式回退传输：下行为长连接分块 GET，上行为批量 POST，通过会话 ID 关联
+// 帧格式: <消息类型 1 字节><长度 u32><内容>，消息类型与 WebSocket 操作码一致
+const (
+	streamTransportHeader = "X-Tunnel-Transport"
+	streamSessionHeader   = "X-Tunnel-Session"
+	streamTransportName   = "stream"
+
+	maxStreamPending  = 4 << 20 // 上行待发送数据上限，超过后 WriteMessage 阻塞
+	streamPostTimeout = 30 * time.Second
+)
+
+var (
+	// 所有 HTTP 流式会话共享的客户端
+	streamMu      sync.Mutex
+	streamClient  *http.Client
+	streamECHList []byte
+
+	// 服务端会话表
+	streamSessionsMu sync.Mutex
+	streamSessions   = make(map[string]*streamSession)
+)
+
+// appendStreamFrame 追加一个帧
+func appendStreamFrame(b []byte, messageType int, data []byte) []byte {
+	b = append(b, byte(messageType))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// readStreamFrame 读取一个帧
+func readStreamFrame(r *bufio.Reader) (int, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > maxWSMessageSize {
+		return 0, nil, errors.New("帧过大")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return int(head[0]), data, nil
+}
+
+// getStreamClient 返回与当前 ECH 配置对应的共享 HTTP 客户端，ECH 配置变化时重建
+func getStreamClient(serverName string, echBytes []byte) (*http.Client, error) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	if streamClient != nil && bytes.Equal(streamECHList, echBytes) {
+		return streamClient, nil
+	}
+
+	tlsCfg, err := buildTLSConfigWithECH(serverName, echBytes)
+	if err != nil {
+		return nil, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", err)
+	}
+	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialTLSWithECH(ctx, network, address, 0, tlsCfg)
+		},
+		ForceAttemptHTTP2:     true,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if streamClient != nil {
+		streamClient.CloseIdleConnections()
+	}
+	streamClient = &http.Client{Transport: transport}
+	streamECHList = echBytes
+	return streamClient, nil
+}
+
+// streamConn 客户端 HTTP 流式通道
+type streamConn struct {
+	client  *http.Client
+	url     string
+	header  http.Header
+	host    string
+	session string
+	body    io.ReadCloser
+	r       *bufio.Reader
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+
+	pingHandler func(appData string) error
+	closeOnce   sync.Once
+}
+
+// dialHTTPStream 打开 HTTP 流式通道：发起下行 GET 并获取会话 ID
+func dialHTTPStream(wsServerAddr string) (tunnelConn, error) {
+	u, err := url.Parse(wsServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("解析 wsServerAddr 失败: %v", err)
+	}
+	echBytes, err := getECHList()
+	if err != nil {
+		return nil, fmt.Errorf("ECH 配置不可用: %v", err)
+	}
+	client, err := getStreamClient(u.Hostname(), echBytes)
+	if err != nil {
+		return nil, err
+	}
+	header, err := handshakeHeader()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		header.Set("Sec-WebSocket-Protocol", token)
+	}
+	host := header.Get("Host")
+	header.Del("Host")
+
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	c := &streamConn{client: client, url: target.String(), header: header, host: host}
+	c.cond = sync.NewCond(&c.mu)
+	c.pingHandler = func(appData string) error {
+		return c.WriteMessage(websocket.PongMessage, []byte(appData))
+	}
+
+	req, err := c.newRequest(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(streamTransportHeader, streamTransportName)
+	resp, err := client.Do(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "ECH") {
+			log.Printf("[ECH] HTTP 流式连接失败（可能 ECH 公钥已轮换）: %v", err)
+			if refreshErr := refreshECH(); refreshErr != nil {
+				log.Printf("[ECH] 刷新失败: %v", refreshErr)
+			}
+		}
+		return nil, err
+	}
+	c.session = resp.Header.Get(streamSessionHeader)
+	if resp.StatusCode != http.StatusOK || c.session == "" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP 流式会话被拒绝: %s", resp.Status)
+	}
+	c.body = resp.Body
+	c.r = bufio.NewReaderSize(resp.Body, 65536)
+	go c.flushLoop()
+	return c, nil
+}
+
+// newRequest 构建携带握手头部的请求
+func (c *streamConn) newRequest(method string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.header.Clone()
+	// 签名认证头部只能使用一次（服务端拒绝重放的 nonce），上行 POST 与 DELETE 每次重新签名
+	if req.Header.Get(authHeaderName) != "" {
+		signed, err := signedAuthHeader()
+		if err != nil {
+			return nil, fmt.Errorf("生成签名认证失败: %v", err)
+		}
+		req.Header.Set(authHeaderName, signed)
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+	if c.session != "" {
+		req.Header.Set(streamSessionHeader, c.session)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return req, nil
+}
+
+// SetPingHandler 设置收到 Ping 时的处理函数
+func (c *streamConn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			return c.WriteMessage(websocket.PongMessage, []byte(appData))
+		}
+	}
+	c.pingHandler = h
+}
+
+// ReadMessage 从下行流读取一条数据消息
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	for {
+		messageType, data, err := readStreamFrame(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch messageType {
+		case websocket.PingMessage:
+			if err := c.pingHandler(string(data)); err != nil {
+				return 0, nil, err
+			}
+		case websocket.PongMessage:
+		case websocket.CloseMessage:
+			return 0, nil, io.EOF
+		default:
+			return messageType, data, nil
+		}
+	}
+}
+
+// WriteMessage 将消息加入上行批次，由 flushLoop 以 POST 发出
+func (c *streamConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.closed && len(c.pending) > maxStreamPending {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return errors.New("HTTP 流式会话已关闭")
+	}
+	c.pending = appendStreamFrame(c.pending, messageType, data)
+	c.cond.Broadcast()
+	return nil
+}
+
+// flushLoop 依次发送上行批次（同一时间仅一个 POST，保证顺序）
+func (c *streamConn) flushLoop() {
+	for {
+		c.mu.Lock()
+		for !c.closed && len(c.pending) == 0 {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		batch := c.pending
+		c.pending = nil
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if err := c.post(batch); err != nil {
+			log.Printf("[客户端] HTTP 流式上行失败: %v", err)
+			c.Close()
+			return
+		}
+	}
+}
+
+// post 发送一个上行批次
+func (c *streamConn) post(batch []byte) error {
+	req, err := c.newRequest(http.MethodPost, batch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), streamPostTimeout)
+	defer cancel()
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("服务端返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// Close 通知服务端结束会话并关闭下行流
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if req, err := c.newRequest(http.MethodDelete, nil); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if resp, err := c.client.Do(req.WithContext(ctx)); err == nil {
+				resp.Body.Close()
+			}
+			cancel()
+		}
+		c.body.Close()
+	})
+	return nil
+}
+
+// isStreamRequest 判断是否为 HTTP 流式传输请求
+func isStreamRequest(r *http.Request) bool {
+	return r.Header.Get(streamTransportHeader) == streamTransportName || r.Header.Get(streamSessionHeader) != ""
+}
+
+// streamSession 服务端 HTTP 流式会话：下行写入 GET 响应，上行来自 POST
+type streamSession struct {
+	id      string
+	owner   peerInfo // 建立会话（GET）的用户与证书身份，上行与结束请求必须一致
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	inbound chan streamFrame
+	done    chan struct{}
+
+	wmu         sync.Mutex
+	pingHandler func(appData string) error
+	closeOnce   sync.Once
+}
+
+// streamFrame 一条上行消息
+type streamFrame struct {
+	messageType int
+	data        []byte
+}
+
+// serveHTTPStream 处理 HTTP 流式传输请求（GET 建立下行并阻塞直到通道结束，POST 上行，DELETE 结束会话）
+func serveHTTPStream(w http.ResponseWriter, r *http.Request, peer peerInfo, slot *channelSlot) {
+	switch r.Method {
+	case http.MethodGet:
+		s := &streamSession{
+			id:      uuid.New().String(),
+			owner:   peer,
+			w:       w,
+			rc:      http.NewResponseController(w),
+			inbound: make(chan streamFrame, 64),
+			done:    make(chan struct{}),
+		}
+		s.pingHandler = func(appData string) error {
+			return s.WriteMessage(websocket.PongMessage, []byte(appData))
+		}
+		w.Header().Set(streamSessionHeader, s.id)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := s.rc.Flush(); err != nil {
+			log.Printf("HTTP 流式响应失败 %s: %v", peer, err)
+			return
+		}
+
+		streamSessionsMu.Lock()
+		streamSessions[s.id] = s
+		streamSessionsMu.Unlock()
+		go func() {
+			select {
+			case <-r.Context().Done():
+				s.Close()
+			case <-s.done:
+			}
+		}()
+
+		log.Printf("新的 HTTP 流式会话来自 %s", peer)
+		handleWebSocket(s, peer, slot)
+
+	case http.MethodPost:
+		s := lookupStreamSession(r.Header.Get(streamSessionHeader), peer)
+		if s == nil {
+			http.Error(w, "Unknown Session", http.StatusNotFound)
+			return
+		}
+		br := bufio.NewReaderSize(r.Body, 65536)
+		for {
+			messageType, data, err := readStreamFrame(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				s.Close()
+				return
+			}
+			select {
+			case s.inbound <- streamFrame{messageType, data}:
+			case <-s.done:
+				http.Error(w, "Session Closed", http.StatusGone)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		s := lookupStreamSession(r.Header.Get(streamSessionHeader), peer)
+		if s == nil {
+			http.Error(w, "Unknown Session", http.StatusNotFound)
+			return
+		}
+		s.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// lookupStreamSession 按会话 ID 查找 peer 建立的会话；其他用户或证书身份得知会话 ID 也无法访问
+func lookupStreamSession(id string, peer peerInfo) *streamSession {
+	streamSessionsMu.Lock()
+	s := streamSessions[id]
+	streamSessionsMu.Unlock()
+	if s == nil || s.owner.user != peer.user || s.owner.identity != peer.identity {
+		return nil
+	}
+	return s
+}
+
+// SetPingHandler 设置收到 Ping 时的处理函数
+func (s *streamSession) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			return s.WriteMessage(websocket.PongMessage, []byte(appData))
+		}
+	}
+	s.pingHandler = h
+}
+
+// ReadMessage 读取一条上行数据消息
+func (s *streamSession) ReadMessage() (int, []byte, error) {
+	for {
+		select {
+		case f := <-s.inbound:
+			switch f.messageType {
+			case websocket.PingMessage:
+				if err := s.pingHandler(string(f.data)); err != nil {
+					return 0, nil, err
+				}
+			case websocket.PongMessage:
+			case websocket.CloseMessage:
+				return 0, nil, io.EOF
+			default:
+				return f.messageType, f.data, nil
+			}
+		case <-s.done:
+			return 0, nil, io.EOF
+		}
+	}
+}
+
+// WriteMessage 向下行流写出一帧并立即刷新
+func (s *streamSession) WriteMessage(messageType int, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.done:
+		return errors.New("HTTP 流式会话已关闭")
+	default:
+	}
+	if _, err := s.w.Write(appendStreamFrame(nil, messageType, data)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// Close 结束会话（之后不再写入响应）
+func (s *streamSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.wmu.Lock()
+		close(s.done)
+		s.wmu.Unlock()
+		streamSessionsMu.Lock()
+		delete(streamSessions, s.id)
+		streamSessionsMu.Unlock()
+	})
+	return nil
+}
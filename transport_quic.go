@@ -0,0 +1,847 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// 流类型（客户端打开流后的第一个字节）
+	quicStreamTCP byte = 1
+	quicStreamUDP byte = 2
+
+	// 流建立结果
+	quicStatusOK      byte = 0
+	quicStatusFail    byte = 1
+	quicStatusRefused byte = 2 // 后跟 <长度 u16><code|reason>
+
+	// 连接级错误码
+	quicCodeNoError      quic.ApplicationErrorCode = 0
+	quicCodeUnauthorized quic.ApplicationErrorCode = 0x101
+
+	quicMigrationCheck = 3 * time.Second
+
+	// maxQUICUDPFrame 控制流上 UDP 数据帧的最大长度（地址长度、地址与最大 UDP 载荷）
+	maxQUICUDPFrame = 1 + 255 + 65535
+)
+
+// quicConfig 客户端与服务端共用的 QUIC 参数
+var quicConfig = &quic.Config{
+	EnableDatagrams:    true,
+	KeepAlivePeriod:    10 * time.Second,
+	MaxIdleTimeout:     30 * time.Second,
+	MaxIncomingStreams: 4096,
+}
+
+// quicTunnel 客户端 QUIC 隧道：每个 TCP 连接对应一个 QUIC 流，UDP 关联的数据走 QUIC datagram
+type quicTunnel struct {
+	serverAddr string // host:port
+	serverName string
+
+	mu         sync.Mutex
+	conn       *quic.Conn
+	ready      chan struct{} // 连接可用时关闭
+	streams    map[string]*quic.Stream
+	udpStreams map[quic.StreamID]string
+}
+
+// newQUICTunnel 解析 quic://host:port 地址
+func newQUICTunnel(serverAddr string) (*quicTunnel, error) {
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("解析 QUIC 服务端地址失败: %v", err)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("QUIC 服务端地址应为 quic://host:port: %s", serverAddr)
+	}
+	return &quicTunnel{
+		serverAddr: u.Host,
+		serverName: u.Hostname(),
+		ready:      make(chan struct{}),
+		streams:    make(map[string]*quic.Stream),
+		udpStreams: make(map[quic.StreamID]string),
+	}, nil
+}
+
+// waitConn 等待 QUIC 连接可用
+func (t *quicTunnel) waitConn(timeout time.Duration) (*quic.Conn, error) {
+	t.mu.Lock()
+	ready := t.ready
+	t.mu.Unlock()
+	select {
+	case <-ready:
+	case <-time.After(timeout):
+		return nil, errors.New("QUIC 连接未建立")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil, errors.New("QUIC 连接已断开")
+	}
+	return t.conn, nil
+}
+
+// dial 建立到服务端的 QUIC 连接（ECH + TLS1.3）并完成身份验证
+func (t *quicTunnel) dial() (*quic.Conn, []*quic.Transport, net.IP, error) {
+	if proxy, err := upstreamProxyFor(t.serverAddr); err != nil || proxy != nil {
+		return nil, nil, nil, errors.New("QUIC 传输基于 UDP，不支持经上游代理连接")
+	}
+	echBytes, err := getECHList()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ECH 配置不可用: %v", err)
+	}
+	tlsCfg, err := buildTLSConfigWithECH(t.serverName, echBytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", err)
+	}
+	tlsCfg.NextProtos = []string{tunnelALPN}
+
+	host, portStr, err := net.SplitHostPort(t.serverAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	ips, err := dialCandidates(host, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		remote := &net.UDPAddr{IP: ip, Port: port}
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("创建 UDP 套接字失败: %v", err)
+		}
+		tr := &quic.Transport{Conn: udpConn}
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		conn, err := tr.Dial(ctx, remote, tlsCfg, quicConfig)
+		cancel()
+		if err != nil {
+			tr.Close()
+			udpConn.Close()
+			if strings.Contains(err.Error(), "ECH") {
+				log.Printf("[ECH] QUIC 连接失败（可能 ECH 公钥已轮换）: %v", err)
+				if refreshErr := refreshECH(); refreshErr != nil {
+					log.Printf("[ECH] 刷新失败: %v", refreshErr)
+				}
+				return nil, nil, nil, err
+			}
+			lastErr = err
+			continue
+		}
+		recordHandshake(conn.ConnectionState().TLS)
+		if err := quicAuthenticate(conn); err != nil {
+			conn.CloseWithError(quicCodeNoError, "")
+			tr.Close()
+			udpConn.Close()
+			return nil, nil, nil, err
+		}
+		return conn, []*quic.Transport{tr}, localIPFor(remote), nil
+	}
+	return nil, nil, nil, fmt.Errorf("所有地址均连接失败: %v", lastErr)
+}
+
+// quicAuthenticate 在第一个流上发送握手头部（token、-header 等），等待服务端准入
+func quicAuthenticate(conn *quic.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(helloTimeout))
+	return sendTunnelHello(stream, bufio.NewReader(stream))
+}
+
+// localIPFor 返回访问 remote 时系统选择的本地地址（不发送数据）
+func localIPFor(remote *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// quicLoop 维持 QUIC 连接：断开后自动重连，本地网络变化时迁移连接
+func (p *ECHPool) quicLoop() {
+	t := p.quic
+	for {
+		conn, transports, localIP, err := t.dial()
+		if err != nil {
+			log.Printf("[客户端] QUIC(ECH) 连接失败: %v，2秒后重试", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		log.Printf("[客户端] QUIC(ECH) 已连接 %s", conn.RemoteAddr())
+
+		t.mu.Lock()
+		t.conn = conn
+		close(t.ready)
+		t.mu.Unlock()
+
+		go p.quicReceiveDatagrams(conn)
+		transports = t.watchMigration(conn, transports, localIP)
+		log.Printf("[客户端] QUIC 连接断开: %v", context.Cause(conn.Context()))
+
+		t.mu.Lock()
+		t.conn = nil
+		t.ready = make(chan struct{})
+		t.mu.Unlock()
+		for _, tr := range transports {
+			tr.Close()
+			tr.Conn.Close()
+		}
+	}
+}
+
+// watchMigration 定期检查本地出口地址，变化时在新套接字上探测新路径并切换（阻塞直到连接结束，返回所有套接字）
+func (t *quicTunnel) watchMigration(conn *quic.Conn, transports []*quic.Transport, localIP net.IP) []*quic.Transport {
+	remote, ok := conn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return transports
+	}
+	ticker := time.NewTicker(quicMigrationCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return transports
+		case <-ticker.C:
+		}
+		current := localIPFor(remote)
+		if current == nil || current.Equal(localIP) {
+			continue
+		}
+		log.Printf("[客户端] 本地网络变化 (%s -> %s)，迁移 QUIC 连接", localIP, current)
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			log.Printf("[客户端] 迁移失败，创建 UDP 套接字失败: %v", err)
+			continue
+		}
+		tr := &quic.Transport{Conn: udpConn}
+		path, err := conn.AddPath(tr)
+		if err != nil {
+			log.Printf("[客户端] 迁移失败: %v", err)
+			tr.Close()
+			udpConn.Close()
+			continue
+		}
+		ctx, cancel := context.WithTimeout(conn.Context(), 5*time.Second)
+		err = path.Probe(ctx)
+		cancel()
+		if err == nil {
+			err = path.Switch()
+		}
+		// 关闭 Transport 会终止其上的连接，因此新旧套接字都保留到连接结束
+		transports = append(transports, tr)
+		if err != nil {
+			log.Printf("[客户端] 新路径验证失败: %v", err)
+			_ = path.Close()
+			continue
+		}
+		localIP = current
+		log.Printf("[客户端] QUIC 连接已迁移到 %s", current)
+	}
+}
+
+// quicOpenTCP 为本地 TCP 连接打开一个 QUIC 流并发送目标地址与首帧
+func (p *ECHPool) quicOpenTCP(connID, target, firstFrame string, tcpConn net.Conn) {
+	t := p.quic
+	fail := func(err error) {
+		log.Printf("[客户端] 连接 %s 建立 QUIC 流失败: %v", connID, err)
+		var r *refusalError
+		if !errors.As(err, &r) {
+			r = nil
+		}
+		p.refuse(connID, r)
+	}
+
+	conn, err := t.waitConn(5 * time.Second)
+	if err != nil {
+		fail(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), 5*time.Second)
+	stream, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := openQUICStream(stream, quicStreamTCP, target, []byte(firstFrame)); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		fail(err)
+		return
+	}
+
+	t.mu.Lock()
+	t.streams[connID] = stream
+	t.mu.Unlock()
+	p.mu.Lock()
+	ch := p.connected[connID]
+	p.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+
+	// 服务端 -> 本地
+	go func() {
+		_, _ = io.Copy(tcpConn, stream)
+		stream.CancelRead(0)
+		_ = stream.Close()
+		_ = tcpConn.Close()
+		t.mu.Lock()
+		delete(t.streams, connID)
+		t.mu.Unlock()
+		p.mu.Lock()
+		delete(p.tcpMap, connID)
+		p.mu.Unlock()
+	}()
+}
+
+// quicStream 返回连接对应的 QUIC 流
+func (t *quicTunnel) stream(connID string) *quic.Stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[connID]
+}
+
+// quicSendData 在 TCP 连接对应的流上发送数据
+func (p *ECHPool) quicSendData(connID string, b []byte) error {
+	stream := p.quic.stream(connID)
+	if stream == nil {
+		return fmt.Errorf("未分配通道")
+	}
+	_, err := stream.Write(b)
+	return err
+}
+
+// quicSendClose 关闭流的发送方向，服务端随后关闭目标连接
+func (p *ECHPool) quicSendClose(connID string) error {
+	stream := p.quic.stream(connID)
+	if stream == nil {
+		return nil
+	}
+	return stream.Close()
+}
+
+// quicSendUDPConnect 为 UDP 关联打开控制流，之后的数据以 datagram 收发
+func (p *ECHPool) quicSendUDPConnect(connID, target string) error {
+	t := p.quic
+	conn, err := t.waitConn(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), 5*time.Second)
+	stream, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if err := openQUICStream(stream, quicStreamUDP, target, nil); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		var r *refusalError
+		if errors.As(err, &r) {
+			p.refuse(connID, r)
+		}
+		return err
+	}
+
+	t.mu.Lock()
+	t.streams[connID] = stream
+	t.udpStreams[stream.StreamID()] = connID
+	t.mu.Unlock()
+	p.mu.Lock()
+	ch := p.connected[connID]
+	p.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+
+	// 控制流上为超出 datagram 上限的 UDP 数据，服务端关闭控制流即结束关联
+	go func() {
+		for {
+			body, err := readQUICUDPFrame(stream)
+			if err != nil {
+				break
+			}
+			if addr, data, err := parseQUICUDPAddr(body); err == nil {
+				p.quicDeliverUDP(stream.StreamID(), addr, data)
+			}
+		}
+		t.mu.Lock()
+		delete(t.udpStreams, stream.StreamID())
+		t.mu.Unlock()
+	}()
+	return nil
+}
+
+// quicSendUDPData 以 datagram 发送 UDP 数据: <流ID uvarint><数据>
+func (p *ECHPool) quicSendUDPData(connID string, data []byte) error {
+	t := p.quic
+	t.mu.Lock()
+	stream := t.streams[connID]
+	conn := t.conn
+	t.mu.Unlock()
+	if stream == nil || conn == nil {
+		return fmt.Errorf("未分配通道")
+	}
+	return sendQUICUDP(conn, stream, data)
+}
+
+// quicSendUDPClose 关闭 UDP 关联的控制流
+func (p *ECHPool) quicSendUDPClose(connID string) error {
+	t := p.quic
+	t.mu.Lock()
+	stream := t.streams[connID]
+	delete(t.streams, connID)
+	if stream != nil {
+		delete(t.udpStreams, stream.StreamID())
+	}
+	t.mu.Unlock()
+
+	p.mu.Lock()
+	delete(p.udpMap, connID)
+	p.mu.Unlock()
+
+	if stream == nil {
+		return nil
+	}
+	stream.CancelRead(0)
+	return stream.Close()
+}
+
+// quicReceiveDatagrams 接收服务端返回的 UDP 数据: <流ID uvarint><地址长度><host:port><数据>
+func (p *ECHPool) quicReceiveDatagrams(conn *quic.Conn) {
+	for {
+		msg, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		id, addr, data, err := parseQUICDatagram(msg, true)
+		if err != nil {
+			continue
+		}
+		p.quicDeliverUDP(id, addr, data)
+	}
+}
+
+// quicDeliverUDP 把服务端返回的 UDP 数据交给对应的 UDP 关联
+func (p *ECHPool) quicDeliverUDP(id quic.StreamID, addr string, data []byte) {
+	p.quic.mu.Lock()
+	connID := p.quic.udpStreams[id]
+	p.quic.mu.Unlock()
+	p.mu.RLock()
+	assoc := p.udpMap[connID]
+	p.mu.RUnlock()
+	if assoc != nil {
+		assoc.handleUDPResponse(addr, data)
+	}
+}
+
+// sendQUICUDP 以 datagram 发送 UDP 关联的数据（<流ID uvarint><内容>），
+// 超出 datagram 上限时改在关联的控制流上以长度前缀帧发送
+func sendQUICUDP(conn *quic.Conn, stream *quic.Stream, body []byte) error {
+	msg := binary.AppendUvarint(nil, uint64(stream.StreamID()))
+	err := conn.SendDatagram(append(msg, body...))
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	_, err = stream.Write(append(frame, body...))
+	return err
+}
+
+// readQUICUDPFrame 读取控制流上的 UDP 数据帧: <长度 u32><内容>，内容格式同 datagram 去掉流 ID 的部分
+func readQUICUDPFrame(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxQUICUDPFrame {
+		return nil, errors.New("UDP 数据帧过大")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// openQUICStream 发送流请求头: <类型><目标长度 u16><目标><首帧长度 u32><首帧>，并等待服务端结果
+func openQUICStream(stream *quic.Stream, typ byte, target string, first []byte) error {
+	req := []byte{typ}
+	req = binary.BigEndian.AppendUint16(req, uint16(len(target)))
+	req = append(req, target...)
+	req = binary.BigEndian.AppendUint32(req, uint32(len(first)))
+	req = append(req, first...)
+
+	_ = stream.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err := stream.Write(req); err != nil {
+		return err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(stream, status[:]); err != nil {
+		return fmt.Errorf("读取服务端结果失败: %v", err)
+	}
+	switch status[0] {
+	case quicStatusOK:
+		_ = stream.SetDeadline(time.Time{})
+		return nil
+	case quicStatusRefused:
+		var l [2]byte
+		if _, err := io.ReadFull(stream, l[:]); err != nil {
+			return fmt.Errorf("读取服务端结果失败: %v", err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(stream, msg); err != nil {
+			return fmt.Errorf("读取服务端结果失败: %v", err)
+		}
+		_, r := parseRefusal("|" + string(msg))
+		return r
+	}
+	return fmt.Errorf("服务端无法连接目标 %s", target)
+}
+
+// writeQUICRefusal 以 quicStatusRefused 回复流请求并结束该流
+func writeQUICRefusal(stream *quic.Stream, err error) {
+	frame := refusalFrame("", err)
+	_, msg, _ := strings.Cut(string(frame), "|")
+	reply := append([]byte{quicStatusRefused}, binary.BigEndian.AppendUint16(nil, uint16(len(msg)))...)
+	_, _ = stream.Write(append(reply, msg...))
+	stream.CancelRead(0)
+	_ = stream.Close()
+}
+
+// readQUICStreamRequest 读取流请求头
+func readQUICStreamRequest(r io.Reader) (byte, string, []byte, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, "", nil, err
+	}
+	target := make([]byte, binary.BigEndian.Uint16(head[1:]))
+	if _, err := io.ReadFull(r, target); err != nil {
+		return 0, "", nil, err
+	}
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, "", nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxWSMessageSize {
+		return 0, "", nil, errors.New("首帧过大")
+	}
+	first := make([]byte, n)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return 0, "", nil, err
+	}
+	return head[0], string(target), first, nil
+}
+
+// parseQUICDatagram 解析 datagram，withAddr 表示包含来源地址（服务端 -> 客户端方向）
+func parseQUICDatagram(msg []byte, withAddr bool) (quic.StreamID, string, []byte, error) {
+	id, n := binary.Uvarint(msg)
+	if n <= 0 {
+		return 0, "", nil, errors.New("无效的 datagram")
+	}
+	msg = msg[n:]
+	if !withAddr {
+		return quic.StreamID(id), "", msg, nil
+	}
+	addr, data, err := parseQUICUDPAddr(msg)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return quic.StreamID(id), addr, data, nil
+}
+
+// parseQUICUDPAddr 拆分服务端返回的 UDP 数据: <地址长度><host:port><数据>
+func parseQUICUDPAddr(msg []byte) (string, []byte, error) {
+	if len(msg) < 1 || len(msg) < 1+int(msg[0]) {
+		return "", nil, errors.New("无效的 datagram")
+	}
+	addrLen := int(msg[0])
+	return string(msg[1 : 1+addrLen]), msg[1+addrLen:], nil
+}
+
+// runQUICServer 运行 QUIC 服务端（-l quic://ip:port）
+func runQUICServer(addr string) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Fatal("无效的 QUIC 地址:", err)
+	}
+	gate, err := newTunnelGate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := buildServerTLSConfig()
+	if err != nil {
+		log.Fatalf("构建服务端 TLS 配置失败: %v", err)
+	}
+	tlsConfig.NextProtos = []string{tunnelALPN}
+	certs, err := newServerCertStore(u)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	udpConn, managed, err := listenPacketInherited(u.Host)
+	if err != nil {
+		log.Fatalf("QUIC 监听失败 %s: %v", u.Host, err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	ln, err := tr.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		log.Fatalf("QUIC 监听失败 %s: %v", u.Host, err)
+	}
+	// 优雅退出时只停止接受新连接；平滑重启后套接字由新进程读取，旧进程的连接随之关闭，客户端自动重连
+	managed.close = func() { _ = ln.Close() }
+	managed.handoff = func() { _ = tr.Close() }
+	log.Printf("QUIC 服务端启动，监听 %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			serveExit(fmt.Errorf("接受 QUIC 连接失败: %v", err))
+		}
+		go handleQUICConn(conn, gate)
+	}
+}
+
+// handleQUICConn 处理单个 QUIC 连接：先在第一个流上完成准入检查，再为每个流转发
+func handleQUICConn(conn *quic.Conn, gate *tunnelGate) {
+	peer, slot, ok := authorizeQUIC(conn, gate)
+	if !ok {
+		// 留出时间让客户端读取拒绝原因
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(time.Second):
+		}
+		_ = conn.CloseWithError(quicCodeUnauthorized, "unauthorized")
+		return
+	}
+	defer slot.release()
+	slot.setCloser(func() { _ = conn.CloseWithError(0, "shutdown") })
+	log.Printf("新的 QUIC 连接来自 %s", peer)
+	revokeOnUserChange(conn.Context().Done(), peer, func() {
+		_ = conn.CloseWithError(quicCodeUnauthorized, "user revoked")
+	})
+
+	var mu sync.Mutex
+	udpAssocs := make(map[quic.StreamID]*quicUDPAssoc)
+
+	// UDP 数据：客户端 datagram -> 目标
+	go func() {
+		for {
+			msg, err := conn.ReceiveDatagram(conn.Context())
+			if err != nil {
+				return
+			}
+			id, _, data, err := parseQUICDatagram(msg, false)
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			a := udpAssocs[id]
+			mu.Unlock()
+			if a != nil {
+				if _, err := a.conn.WriteToUDP(data, a.target); err != nil {
+					log.Printf("[服务端UDP:%d] 发送到目标失败: %v", id, err)
+				} else {
+					a.st.addUp(len(data))
+				}
+			}
+		}
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			if !isNormalCloseError(err) {
+				log.Printf("QUIC 连接 %s 结束: %v", peer, err)
+			}
+			return
+		}
+		go func() {
+			typ, target, first, err := readQUICStreamRequest(stream)
+			if err != nil {
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+				return
+			}
+			kind := "tcp"
+			if typ == quicStreamUDP {
+				kind = "udp"
+			}
+			// 超出并发流或新建速率限制时以 REFUSED 拒绝
+			st, err := slot.acquireStream(strconv.FormatInt(int64(stream.StreamID()), 10), kind, target)
+			if err != nil {
+				writeQUICRefusal(stream, err)
+				return
+			}
+			defer st.release()
+			switch typ {
+			case quicStreamTCP:
+				serveQUICTCP(conn, stream, peer, st, target, first)
+			case quicStreamUDP:
+				serveQUICUDP(conn, stream, peer, st, target, &mu, udpAssocs)
+			default:
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+			}
+		}()
+	}
+}
+
+// authorizeQUIC 读取客户端握手头部，复用 WebSocket 的准入检查（来源 IP、Token、请求头部）
+func authorizeQUIC(conn *quic.Conn, gate *tunnelGate) (peerInfo, *channelSlot, bool) {
+	ctx, cancel := context.WithTimeout(conn.Context(), helloTimeout)
+	defer cancel()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		log.Printf("QUIC 连接 %s 未发送握手: %v", conn.RemoteAddr(), err)
+		return peerInfo{}, nil, false
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(helloTimeout))
+
+	cs := conn.ConnectionState().TLS
+	return acceptTunnelHello(stream, bufio.NewReader(stream), conn.RemoteAddr().String(), &cs, gate)
+}
+
+// serveQUICTCP 连接目标并在 QUIC 流与目标 TCP 连接之间双向转发
+func serveQUICTCP(conn *quic.Conn, stream *quic.Stream, peer peerInfo, st *streamSlot, target string, first []byte) {
+	log.Printf("[服务端] 请求TCP转发，流: %d，目标: %s，首帧长度: %d", stream.StreamID(), target, len(first))
+	tcpConn, err := dialTarget(conn.Context(), peer, target)
+	if err == nil {
+		tcpConn = &countingConn{Conn: tcpConn, st: st}
+		st.setCloser(func() { _ = tcpConn.Close() })
+	}
+	if err == nil && len(first) > 0 {
+		if _, err = tcpConn.Write(first); err != nil {
+			tcpConn.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("[服务端] 连接目标地址 %s 失败: %v", target, err)
+		writeQUICRefusal(stream, err)
+		return
+	}
+	if _, err := stream.Write([]byte{quicStatusOK}); err != nil {
+		tcpConn.Close()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// 客户端关闭发送方向即关闭目标连接
+		_, _ = io.Copy(tcpConn, stream)
+		_ = tcpConn.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(stream, tcpConn)
+	_ = stream.Close()
+	_ = tcpConn.Close()
+	<-done
+	stream.CancelRead(0)
+	log.Printf("[服务端] TCP连接已清理，流: %d", stream.StreamID())
+}
+
+// quicUDPAssoc QUIC 连接中的一个 UDP 关联
+type quicUDPAssoc struct {
+	conn   udpSocket
+	target *net.UDPAddr
+	st     *streamSlot
+}
+
+// serveQUICUDP 为 UDP 关联创建套接字，控制流关闭时结束关联
+func serveQUICUDP(conn *quic.Conn, stream *quic.Stream, peer peerInfo, st *streamSlot, target string, mu *sync.Mutex,
+	udpAssocs map[quic.StreamID]*quicUDPAssoc) {
+	id := stream.StreamID()
+	log.Printf("[服务端UDP:%d] 收到UDP连接请求，目标: %s", id, target)
+
+	udpConn, udpAddr, err := listenUDPTarget(conn.Context(), peer, target)
+	if err != nil {
+		log.Printf("[服务端UDP:%d] 建立失败: %v", id, err)
+		writeQUICRefusal(stream, err)
+		return
+	}
+	mu.Lock()
+	udpAssocs[id] = &quicUDPAssoc{conn: udpConn, target: udpAddr, st: st}
+	mu.Unlock()
+	st.setCloser(func() {
+		_ = udpConn.Close()
+		stream.CancelRead(0)
+	})
+	defer func() {
+		mu.Lock()
+		delete(udpAssocs, id)
+		mu.Unlock()
+		_ = udpConn.Close()
+		_ = stream.Close()
+		log.Printf("[服务端UDP:%d] 连接已关闭", id)
+	}()
+
+	if _, err := stream.Write([]byte{quicStatusOK}); err != nil {
+		return
+	}
+
+	// 目标 -> 客户端
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := udpConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			st.addDown(n)
+			from := addr.String()
+			body := append(append([]byte{byte(len(from))}, from...), buffer[:n]...)
+			if err := sendQUICUDP(conn, stream, body); err != nil {
+				log.Printf("[服务端UDP:%d] 发送 datagram 失败: %v", id, err)
+			}
+		}
+	}()
+
+	// 控制流上为超出 datagram 上限的客户端数据，客户端关闭控制流即结束关联
+	for {
+		data, err := readQUICUDPFrame(stream)
+		if err != nil {
+			return
+		}
+		if _, err := udpConn.WriteToUDP(data, udpAddr); err != nil {
+			log.Printf("[服务端UDP:%d] 发送到目标失败: %v", id, err)
+		} else {
+			st.addUp(len(data))
+		}
+	}
+}
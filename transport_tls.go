@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameConn 直接在 TLS 连接上以 <类型><长度 u32><内容> 帧承载隧道消息（tls:// 传输，无 WebSocket 层）
+type frameConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmu         sync.Mutex
+	pingHandler func(appData string) error
+	closeOnce   sync.Once
+}
+
+// newFrameConn 创建帧连接，r 为握手阶段已使用的读缓冲
+func newFrameConn(conn net.Conn, r *bufio.Reader) *frameConn {
+	c := &frameConn{conn: conn, r: r}
+	c.pingHandler = func(appData string) error {
+		return c.WriteMessage(websocket.PongMessage, []byte(appData))
+	}
+	return c
+}
+
+// SetPingHandler 设置收到 Ping 时的处理函数
+func (c *frameConn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			return c.WriteMessage(websocket.PongMessage, []byte(appData))
+		}
+	}
+	c.pingHandler = h
+}
+
+// ReadMessage 读取一条数据消息（自动处理 Ping/Pong/Close）
+func (c *frameConn) ReadMessage() (int, []byte, error) {
+	for {
+		messageType, data, err := readStreamFrame(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch messageType {
+		case websocket.PingMessage:
+			if err := c.pingHandler(string(data)); err != nil {
+				return 0, nil, err
+			}
+		case websocket.PongMessage:
+		case websocket.CloseMessage:
+			return 0, nil, io.EOF
+		default:
+			return messageType, data, nil
+		}
+	}
+}
+
+// WriteMessage 写出一帧
+func (c *frameConn) WriteMessage(messageType int, data []byte) error {
+	frame := appendStreamFrame(make([]byte, 0, len(data)+5), messageType, data)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close 发送关闭帧并关闭连接
+func (c *frameConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.WriteMessage(websocket.CloseMessage, nil)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// dialRawTLS 建立 tls:// 通道：TLS 1.3(ECH) 握手后交换握手头部，随后直接收发隧道帧
+func dialRawTLS(serverAddr string, channel, maxRetries int) (tunnelConn, error) {
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("解析服务端地址失败: %v", err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("tls:// 服务端地址需指定端口: %s", serverAddr)
+	}
+
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		echBytes, err := getECHList()
+		if err != nil {
+			if attempt < maxRetries {
+				if refreshErr := refreshECH(); refreshErr != nil {
+					log.Printf("[ECH] 刷新失败: %v", refreshErr)
+				}
+				continue
+			}
+			return nil, fmt.Errorf("ECH 配置不可用: %v", err)
+		}
+		tlsCfg, err := buildTLSConfigWithECH(u.Hostname(), echBytes)
+		if err != nil {
+			return nil, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", err)
+		}
+		tlsCfg.NextProtos = []string{tunnelALPN}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		conn, err := dialTLSWithECH(ctx, "tcp", u.Host, channel, tlsCfg)
+		cancel()
+		if err != nil {
+			if strings.Contains(err.Error(), "ECH") && attempt < maxRetries {
+				log.Printf("[ECH] 连接失败（可能 ECH 公钥已轮换），刷新后重试 (尝试 %d/%d): %v", attempt, maxRetries, err)
+				if refreshErr := refreshECH(); refreshErr != nil {
+					log.Printf("[ECH] 刷新失败: %v", refreshErr)
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(helloTimeout))
+		br := bufio.NewReaderSize(conn, 65536)
+		if err := sendTunnelHello(conn, br); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return newFrameConn(conn, br), nil
+	}
+	return nil, fmt.Errorf("TLS 连接失败，已达最大重试次数")
+}
+
+// runRawTLSServer 运行 tls:// 服务端（无 WebSocket 层）
+func runRawTLSServer(addr string) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Fatal("无效的 TLS 地址:", err)
+	}
+	gate, err := newTunnelGate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := buildServerTLSConfig()
+	if err != nil {
+		log.Fatalf("构建服务端 TLS 配置失败: %v", err)
+	}
+	tlsConfig.NextProtos = []string{tunnelALPN}
+	certs, err := newServerCertStore(u)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	tcpLn, err := listenServer(u.Host)
+	if err != nil {
+		log.Fatalf("TLS 监听失败 %s: %v", u.Host, err)
+	}
+	ln := tls.NewListener(tcpLn, tlsConfig)
+	log.Printf("TLS 服务端启动，监听 %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			waitExit()
+			log.Printf("接受连接失败: %v", err)
+			continue
+		}
+		go handleRawTLSConn(conn.(*tls.Conn), gate)
+	}
+}
+
+// handleRawTLSConn 完成握手与准入检查后，按 WebSocket 通道相同的方式处理隧道消息
+func handleRawTLSConn(conn *tls.Conn, gate *tunnelGate) {
+	_ = conn.SetDeadline(time.Now().Add(helloTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("TLS 握手失败 %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	br := bufio.NewReaderSize(conn, 65536)
+	cs := conn.ConnectionState()
+	peer, slot, ok := acceptTunnelHello(conn, br, conn.RemoteAddr().String(), &cs, gate)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer slot.release()
+	slot.setCloser(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Time{})
+
+	log.Printf("新的 TLS 通道来自 %s", peer)
+	handleWebSocket(newFrameConn(conn, br), peer, slot)
+}
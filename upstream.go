@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// upstreamProxy 出站上游代理（HTTP CONNECT 或 SOCKS5）
+type upstreamProxy struct {
+	scheme   string
+	addr     string
+	username string
+	password string
+	// dial 连接代理服务器本身（服务端出站可指定源地址），为空时直连
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+var (
+	upstreamOnce  sync.Once
+	upstream      *upstreamProxy
+	upstreamError error
+	// upstreamNoProxy 来自环境变量的代理按 NO_PROXY 判断是否使用，返回 nil 表示直连
+	upstreamNoProxy func(*url.URL) (*url.URL, error)
+)
+
+// parseUpstreamProxy 解析上游代理地址: http://[user:pass@]host:port 或 socks5://[user:pass@]host:port
+func parseUpstreamProxy(raw string) (*upstreamProxy, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("无效的上游代理地址: %v", err)
+	}
+	p := &upstreamProxy{scheme: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "http":
+		if u.Port() == "" {
+			p.addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "socks5", "socks5h":
+		p.scheme = "socks5"
+		if u.Port() == "" {
+			p.addr = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	default:
+		return nil, fmt.Errorf("不支持的上游代理协议: %s（仅支持 http:// 与 socks5://）", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("上游代理地址缺少主机: %s", raw)
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// getUpstreamProxy 返回客户端使用的上游代理（-upstream-proxy 优先，其次 HTTPS_PROXY/ALL_PROXY 环境变量）
+func getUpstreamProxy() (*upstreamProxy, error) {
+	upstreamOnce.Do(func() {
+		raw := upstreamProxyAddr
+		if raw == "" {
+			raw = firstEnv("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+			if raw != "" {
+				cfg := &httpproxy.Config{HTTPSProxy: raw, NoProxy: firstEnv("NO_PROXY", "no_proxy")}
+				upstreamNoProxy = cfg.ProxyFunc()
+			}
+		}
+		if raw == "" {
+			return
+		}
+		upstream, upstreamError = parseUpstreamProxy(raw)
+		if upstreamError == nil {
+			log.Printf("[客户端] 使用上游代理: %s://%s", upstream.scheme, upstream.addr)
+		}
+	})
+	return upstream, upstreamError
+}
+
+// upstreamProxyFor 返回连接 address（主机名:端口）时使用的上游代理；
+// -upstream-proxy 对所有地址生效，来自环境变量的代理不用于 NO_PROXY 列出的主机及本机地址
+func upstreamProxyFor(address string) (*upstreamProxy, error) {
+	proxy, err := getUpstreamProxy()
+	if err != nil || proxy == nil || upstreamNoProxy == nil {
+		return proxy, err
+	}
+	if u, err := upstreamNoProxy(&url.URL{Scheme: "https", Host: address}); err == nil && u == nil {
+		return nil, nil
+	}
+	return proxy, nil
+}
+
+// firstEnv 返回第一个非空的环境变量
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// dialOutbound 客户端出站拨号：address 对应上游代理时经代理隧道连接，否则直连
+func dialOutbound(ctx context.Context, network, address string) (net.Conn, error) {
+	proxy, err := upstreamProxyFor(address)
+	if err != nil {
+		return nil, err
+	}
+	return dialVia(ctx, proxy, network, address)
+}
+
+// dialVia 经 proxy 连接 address，proxy 为 nil 时直连
+func dialVia(ctx context.Context, proxy *upstreamProxy, network, address string) (net.Conn, error) {
+	if proxy == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	return proxy.DialContext(ctx, network, address)
+}
+
+// connect 连接代理服务器，并按 ctx（未设置时按 dialTimeout）设置握手期限
+func (p *upstreamProxy) connect(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.dial != nil {
+		conn, err = p.dial(ctx, "tcp", p.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", p.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("连接上游代理 %s 失败: %v", p.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	}
+	return conn, nil
+}
+
+// DialContext 通过上游代理建立到 address 的 TCP 隧道
+func (p *upstreamProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel := conn
+	if p.scheme == "http" {
+		tunnel, err = p.handshakeHTTP(conn, address)
+	} else {
+		err = p.handshakeSOCKS5(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("上游代理 %s 握手失败: %v", p.addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// handshakeHTTP 发送 HTTP CONNECT 请求建立隧道
+func (p *upstreamProxy) handshakeHTTP(conn net.Conn, address string) (net.Conn, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if p.username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, fmt.Errorf("读取 CONNECT 响应失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s 被拒绝: %s", address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// handshakeSOCKS5 完成 SOCKS5 认证协商与 CONNECT 请求
+func (p *upstreamProxy) handshakeSOCKS5(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("无效的端口: %s", portStr)
+	}
+	if err := p.authSOCKS5(conn); err != nil {
+		return err
+	}
+
+	req := []byte{0x05, ConnectCmd, 0x00}
+	req = appendSOCKS5Addr(req, host)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	_, err = readSOCKS5Reply(conn)
+	return err
+}
+
+// authSOCKS5 完成 SOCKS5 认证方法协商（及用户名密码认证）
+func (p *upstreamProxy) authSOCKS5(conn net.Conn) error {
+	methods := []byte{NoAuth}
+	if p.username != "" {
+		methods = []byte{NoAuth, UserPassAuth}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("读取认证方法响应失败: %v", err)
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("不支持的SOCKS版本: %d", buf[0])
+	}
+	switch buf[1] {
+	case NoAuth:
+	case UserPassAuth:
+		if p.username == "" {
+			return errors.New("代理要求用户名密码认证")
+		}
+		auth := []byte{0x01, byte(len(p.username))}
+		auth = append(auth, p.username...)
+		auth = append(auth, byte(len(p.password)))
+		auth = append(auth, p.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("读取认证响应失败: %v", err)
+		}
+		if buf[1] != 0x00 {
+			return errors.New("用户名或密码错误")
+		}
+	default:
+		return errors.New("没有可接受的认证方法")
+	}
+	return nil
+}
+
+// associateUDP 向 SOCKS5 代理请求 UDP ASSOCIATE，返回经代理中继收发的 UDP 套接字
+func (p *upstreamProxy) associateUDP(ctx context.Context) (*socks5UDPConn, error) {
+	ctrl, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := p.requestUDPAssociate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("上游代理 %s UDP 关联失败: %v", p.addr, err)
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+
+	// 从控制连接的本地地址发送，与出站源地址一致
+	var laddr *net.UDPAddr
+	if tcpAddr, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		laddr = &net.UDPAddr{IP: tcpAddr.IP}
+	}
+	udp, err := net.DialUDP("udp", laddr, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("连接上游代理 UDP 中继 %s 失败: %v", relay, err)
+	}
+	c := &socks5UDPConn{UDPConn: udp, ctrl: ctrl, buf: make([]byte, 65535)}
+	// 控制连接断开即关联结束
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = udp.Close()
+	}()
+	return c, nil
+}
+
+// requestUDPAssociate 完成认证并发送 UDP ASSOCIATE 请求，返回代理的 UDP 中继地址
+func (p *upstreamProxy) requestUDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
+	if err := p.authSOCKS5(conn); err != nil {
+		return nil, err
+	}
+	// 客户端发送地址未知，填 0.0.0.0:0
+	if _, err := conn.Write([]byte{0x05, UDPAssociateCmd, 0x00, IPv4Addr, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	bound, err := readSOCKS5Reply(conn)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		return nil, fmt.Errorf("无效的中继地址 %s: %v", bound, err)
+	}
+	// 中继地址为 0.0.0.0 或 :: 时使用代理服务器的地址
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
+	}
+	return relay, nil
+}
+
+// socks5UDPConn 经上游 SOCKS5 代理中继的 UDP 套接字，收发的数据包带 SOCKS5 UDP 头部
+type socks5UDPConn struct {
+	*net.UDPConn // 已连接到代理的 UDP 中继地址
+	ctrl         net.Conn
+	buf          []byte
+}
+
+// WriteToUDP 经中继发送到 addr
+func (c *socks5UDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	packet, err := buildSOCKS5UDPPacket(addr.IP.String(), addr.Port, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP 读取中继转回的数据包，返回其中的来源地址
+func (c *socks5UDPConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, err := c.UDPConn.Read(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		from, data, err := parseSOCKS5UDPPacket(c.buf[:n])
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddrPort(from)
+		if err != nil {
+			continue
+		}
+		return copy(b, data), net.UDPAddrFromAddrPort(addr), nil
+	}
+}
+
+// Close 关闭 UDP 套接字与控制连接
+func (c *socks5UDPConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// appendSOCKS5Addr 按 SOCKS5 地址格式追加目标主机
+func appendSOCKS5Addr(b []byte, host string) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return append(append(b, IPv4Addr), ip4...)
+		}
+		return append(append(b, IPv6Addr), ip.To16()...)
+	}
+	b = append(b, DomainAddr, byte(len(host)))
+	return append(b, host...)
+}
+
+// readSOCKS5Reply 读取 SOCKS5 请求响应，返回绑定地址（host:port）
+func readSOCKS5Reply(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("读取响应失败: %v", err)
+	}
+	if header[1] != Succeeded {
+		return "", fmt.Errorf("请求被拒绝，状态码: %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case IPv4Addr:
+		addrLen = net.IPv4len
+	case IPv6Addr:
+		addrLen = net.IPv6len
+	case DomainAddr:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		addrLen = int(l[0])
+	default:
+		return "", fmt.Errorf("不支持的地址类型: %d", header[3])
+	}
+	b := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	host := string(b[:addrLen])
+	if header[3] != DomainAddr {
+		host = net.IP(b[:addrLen]).String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[addrLen:])))), nil
+}
+
+// bufferedConn 在读取 CONNECT 响应时已缓冲部分数据的连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
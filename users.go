@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// userRecord 用户文件中的一条用户记录
+type userRecord struct {
+	Name      string `json:"name" yaml:"name"`
+	Token     string `json:"token" yaml:"token"`           // 静态令牌（旧方式）
+	Secret    string `json:"secret" yaml:"secret"`         // 签名认证的 HMAC 共享密钥
+	PublicKey string `json:"public_key" yaml:"public_key"` // 签名认证的 Ed25519 公钥（base64）
+	Disabled  bool   `json:"disabled" yaml:"disabled"`
+	Expires   string `json:"expires" yaml:"expires"` // RFC 3339 时间或 YYYY-MM-DD，为空表示不过期
+
+	Egress *userEgress `json:"egress" yaml:"egress"` // 该用户的目标访问策略，未配置时使用全局策略
+
+	Outbound string   `json:"outbound" yaml:"outbound"` // 该用户的默认出站（格式同 -egress-outbound）
+	Routes   []string `json:"routes" yaml:"routes"`     // 该用户的出站路由（格式同 -egress-route），优先于全局路由
+}
+
+// userEgress 用户的目标访问策略（规则格式同 -egress-allow/-egress-deny）
+type userEgress struct {
+	Allow        []string `json:"allow" yaml:"allow"`
+	Deny         []string `json:"deny" yaml:"deny"`
+	AllowPrivate bool     `json:"allow_private" yaml:"allow_private"`
+}
+
+// usersFile 用户文件格式（JSON 或 YAML）
+type usersFile struct {
+	Users []userRecord `json:"users" yaml:"users"`
+}
+
+// userEntry 已解析的用户
+type userEntry struct {
+	name      string
+	hasToken  bool
+	tokenHash [sha256.Size]byte
+	secret    []byte
+	publicKey ed25519.PublicKey
+	disabled  bool
+	expires   time.Time
+	egress    *egressPolicy
+	outbound  *outbound
+	routes    []egressRoute
+}
+
+// active 判断用户当前是否可用
+func (u *userEntry) active(now time.Time) bool {
+	return !u.disabled && (u.expires.IsZero() || now.Before(u.expires))
+}
+
+// userDB 服务端用户数据库（-users），文件变化或收到 SIGHUP 时重新加载
+type userDB struct {
+	path string
+
+	mu      sync.RWMutex
+	users   []*userEntry
+	changed chan struct{} // 每次重新加载后关闭并替换，用于通知已建立的通道重新检查用户状态
+}
+
+var (
+	userDBOnce sync.Once
+	userDBInst *userDB
+	userDBErr  error
+)
+
+// getUserDB 返回 -users 指定的用户数据库，未指定时返回 nil
+func getUserDB() (*userDB, error) {
+	userDBOnce.Do(func() {
+		if usersPath == "" {
+			return
+		}
+		db := &userDB{path: usersPath, changed: make(chan struct{})}
+		stamp := fileStamp([]string{usersPath})
+		if userDBErr = db.reload(); userDBErr != nil {
+			return
+		}
+		userDBInst = db
+		go watchFiles("用户", []string{usersPath}, stamp, db.reload)
+	})
+	return userDBInst, userDBErr
+}
+
+// reload 重新读取用户文件
+func (db *userDB) reload() error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("读取用户文件失败: %w", err)
+	}
+	var file usersFile
+	switch strings.ToLower(filepath.Ext(db.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("解析用户文件失败: %w", err)
+	}
+
+	users := make([]*userEntry, 0, len(file.Users))
+	seen := make(map[string]bool)
+	for i, rec := range file.Users {
+		if rec.Name == "" || rec.Token == "" && rec.Secret == "" && rec.PublicKey == "" {
+			return fmt.Errorf("第 %d 个用户缺少 name 或凭据（token、secret、public_key）", i+1)
+		}
+		if seen[rec.Name] {
+			return fmt.Errorf("用户名重复: %s", rec.Name)
+		}
+		seen[rec.Name] = true
+		entry := &userEntry{
+			name:      rec.Name,
+			hasToken:  rec.Token != "",
+			tokenHash: sha256.Sum256([]byte(rec.Token)),
+			disabled:  rec.Disabled,
+		}
+		if rec.Secret != "" {
+			entry.secret = []byte(rec.Secret)
+		}
+		if rec.Egress != nil {
+			if entry.egress, err = newEgressPolicy(rec.Egress.Allow, rec.Egress.Deny, rec.Egress.AllowPrivate); err != nil {
+				return fmt.Errorf("用户 %s 的 egress 无效: %v", rec.Name, err)
+			}
+		}
+		if rec.Outbound != "" {
+			if entry.outbound, err = parseOutbound(rec.Outbound); err != nil {
+				return fmt.Errorf("用户 %s 的 outbound 无效: %v", rec.Name, err)
+			}
+		}
+		if entry.routes, err = parseEgressRoutes(rec.Routes); err != nil {
+			return fmt.Errorf("用户 %s 的 routes 无效: %v", rec.Name, err)
+		}
+		if rec.PublicKey != "" {
+			if entry.publicKey, err = parseEd25519PublicKey(rec.PublicKey); err != nil {
+				return fmt.Errorf("用户 %s 的 public_key 无效: %v", rec.Name, err)
+			}
+		}
+		if rec.Expires != "" {
+			if entry.expires, err = parseExpiry(rec.Expires); err != nil {
+				return fmt.Errorf("用户 %s 的 expires 无效: %v", rec.Name, err)
+			}
+		}
+		users = append(users, entry)
+	}
+
+	db.mu.Lock()
+	db.users = users
+	close(db.changed)
+	db.changed = make(chan struct{})
+	db.mu.Unlock()
+	log.Printf("已加载用户文件 %s（%d 个用户）", db.path, len(users))
+	return nil
+}
+
+// parseExpiry 解析过期时间（RFC 3339 或 YYYY-MM-DD，后者表示当天结束前有效）
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("格式应为 RFC 3339 或 YYYY-MM-DD")
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// authenticate 以常数时间比较令牌，返回匹配的可用用户名
+// 遍历全部用户且不提前返回，耗时与令牌是否匹配及匹配位置无关
+func (db *userDB) authenticate(token string) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var matched *userEntry
+	for _, u := range db.users {
+		if subtle.ConstantTimeCompare(hash[:], u.tokenHash[:]) == 1 && u.hasToken {
+			matched = u
+		}
+	}
+	switch {
+	case matched == nil:
+		return "", errors.New("令牌无效")
+	case matched.disabled:
+		return "", fmt.Errorf("用户 %s 已禁用", matched.name)
+	case !matched.active(now):
+		return "", fmt.Errorf("用户 %s 已过期", matched.name)
+	}
+	return matched.name, nil
+}
+
+// lookup 按用户名查找用户，不存在时返回 nil
+func (db *userDB) lookup(name string) *userEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, u := range db.users {
+		if u.name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// active 判断用户是否仍然存在且可用
+func (db *userDB) active(name string) bool {
+	u := db.lookup(name)
+	return u != nil && u.active(time.Now())
+}
+
+// watchUser 在用户被删除、禁用或过期时调用 revoke，done 关闭时返回
+func (db *userDB) watchUser(done <-chan struct{}, name string, revoke func()) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		db.mu.RLock()
+		changed := db.changed
+		db.mu.RUnlock()
+		select {
+		case <-done:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+		if !db.active(name) {
+			revoke()
+			return
+		}
+	}
+}
+
+// revokeOnUserChange 通道所属用户被删除、禁用或过期时调用 closeChannel 关闭通道
+func revokeOnUserChange(done <-chan struct{}, peer peerInfo, closeChannel func()) {
+	db, _ := getUserDB()
+	if db == nil || peer.user == "" {
+		return
+	}
+	go db.watchUser(done, peer.user, func() {
+		log.Printf("用户 %s 已失效，关闭通道 %s", peer.user, peer)
+		closeChannel()
+	})
+}
+
+// checkToken 以常数时间比较全局 -token
+func checkToken(got string) bool {
+	a := sha256.Sum256([]byte(got))
+	b := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
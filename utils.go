@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"net/http"
 	"strings"
 )
 
@@ -19,3 +21,29 @@ func isNormalCloseError(err error) bool {
 		strings.Contains(errStr, "connection reset by peer") ||
 		strings.Contains(errStr, "normal closure")
 }
+
+// stringList 可重复指定的命令行参数
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// parseHeaderList 解析 "K: V" 形式的头部列表（省略值时表示仅要求存在该头部）
+func parseHeaderList(list []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, item := range list {
+		k, v, _ := strings.Cut(item, ":")
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return nil, fmt.Errorf("无效的头部: %q（格式应为 \"K: V\"）", item)
+		}
+		header.Add(k, strings.TrimSpace(v))
+	}
+	return header, nil
+}
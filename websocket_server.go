@@ -2,15 +2,9 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,44 +13,9 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme"
 )
 
-// generateSelfSignedCert 生成自签名证书
-func generateSelfSignedCert() (tls.Certificate, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"自签名组织"},
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(10 * 365 * 24 * time.Hour),
-		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageServerAuth,
-		},
-		BasicConstraintsValid: true,
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-	return cert, nil
-}
-
 // runWebSocketServer 运行 WebSocket 服务端
 func runWebSocketServer(addr string) {
 	u, err := url.Parse(addr)
@@ -64,19 +23,22 @@ func runWebSocketServer(addr string) {
 		log.Fatal("无效的 WebSocket 地址:", err)
 	}
 
-	path := u.Path
+	// ws+unix:///run/ech-tunnel.sock:/path 监听 unix 套接字，供本机反向代理转发
+	bind, path := u.Host, u.Path
+	if u.Scheme == "ws+unix" {
+		sock, p, _ := strings.Cut(u.Path, ":")
+		if sock == "" {
+			log.Fatal("无效的 WebSocket 地址: 缺少 unix 套接字路径")
+		}
+		bind, path = "unix:"+sock, p
+	}
 	if path == "" {
 		path = "/"
 	}
 
-	// 解析多个 CIDR 范围
-	var allowedNets []*net.IPNet
-	for _, cidr := range strings.Split(cidrs, ",") {
-		_, allowedNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
-		if err != nil {
-			log.Fatalf("无法解析 CIDR: %v", err)
-		}
-		allowedNets = append(allowedNets, allowedNet)
+	gate, err := newTunnelGate()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	upgrader := websocket.Upgrader{
@@ -91,39 +53,49 @@ func runWebSocketServer(addr string) {
 		WriteBufferSize: 65536, // 增加写缓冲区到64KB
 	}
 
+	// 伪装站点：非隧道请求、其他路径及未通过准入检查的请求都由它响应
+	var fallback http.Handler
+	if fallbackTarget != "" {
+		if fallback, err = newFallbackHandler(fallbackTarget); err != nil {
+			log.Fatal(err)
+		}
+		if path != "/" {
+			http.Handle("/", fallback)
+		}
+	}
+
 	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		// 验证来源IP
-		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			log.Printf("无法解析客户端地址: %v", err)
-			w.Header().Set("Connection", "close")
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		if fallback != nil && (r.URL.Path != path || !isTunnelRequest(r)) {
+			fallback.ServeHTTP(w, r)
 			return
 		}
-		clientIPAddr := net.ParseIP(clientIP)
-		allowed := false
-		for _, allowedNet := range allowedNets {
-			if allowedNet.Contains(clientIPAddr) {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			log.Printf("拒绝访问: IP %s 不在允许的范围内 (%s)", clientIP, cidrs)
-			w.Header().Set("Connection", "close")
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		peer, ok := authorizeOrFallback(gate, fallback, w, r)
+		if !ok {
 			return
 		}
 
-		// 验证 Subprotocol token
-		if token != "" {
-			clientToken := r.Header.Get("Sec-WebSocket-Protocol")
-			if clientToken != token {
-				log.Printf("Token验证失败，来自 %s", r.RemoteAddr)
+		// 建立通道的请求（HTTP 流式传输的上行 POST 等除外）占用通道名额，通道结束时归还
+		var slot *channelSlot
+		if !isStreamRequest(r) || r.Method == http.MethodGet {
+			var err error
+			if slot, err = limits.acquireChannel(peer); err != nil {
 				w.Header().Set("Connection", "close")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 				return
 			}
+			defer slot.release()
+		}
+
+		// HTTP/2 extended CONNECT (RFC 8441)
+		if isExtendedConnect(r) {
+			serveH2WebSocket(w, r, peer, slot)
+			return
+		}
+
+		// HTTP 流式回退传输（网络不支持 WebSocket 升级时）
+		if isStreamRequest(r) {
+			serveHTTPStream(w, r, peer, slot)
+			return
 		}
 
 		wsConn, err := upgrader.Upgrade(w, r, nil)
@@ -132,41 +104,239 @@ func runWebSocketServer(addr string) {
 			return
 		}
 
-		log.Printf("新的 WebSocket 连接来自 %s", r.RemoteAddr)
-		go handleWebSocket(wsConn)
+		log.Printf("新的 WebSocket 连接来自 %s", peer)
+		handleWebSocket(wsConn, peer, slot)
 	})
 
 	// 启动服务器
 	if u.Scheme == "wss" {
+		if useH2 {
+			// net/http 默认关闭服务端 extended CONNECT，需在进程启动时通过 GODEBUG 开启
+			if err := ensureGODEBUG("http2xconnect=1"); err != nil {
+				log.Fatalf("启用 HTTP/2 extended CONNECT 失败: %v", err)
+			}
+			log.Printf("已启用 HTTP/2 extended CONNECT (RFC 8441) 传输")
+		}
 		server := &http.Server{
 			Addr: u.Host,
 		}
+		tlsConfig, err := buildServerTLSConfig()
+		if err != nil {
+			log.Fatalf("构建服务端 TLS 配置失败: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+
+		if len(acmeDomains) > 0 {
+			manager, err := newACMEManager()
+			if err != nil {
+				log.Fatal(err)
+			}
+			// 同时指定 -cert/-key 时，与其 SNI 匹配的连接仍使用这些证书
+			var static *certStore
+			if certFile != "" || keyFile != "" {
+				if static, err = newServerCertStore(u); err != nil {
+					log.Fatal(err)
+				}
+			}
+			// TLS-ALPN-01 挑战通过 acme-tls/1 ALPN 在同一 TLS 监听上应答
+			tlsConfig.GetCertificate = acmeGetCertificate(manager, static)
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
 
-		if certFile != "" && keyFile != "" {
-			log.Printf("WebSocket 服务端使用提供的TLS证书启动，监听 %s%s", u.Host, path)
-			server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13}
-			log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+			ln, err := listenServer(u.Host)
+			if err != nil {
+				log.Fatalf("监听失败 %s: %v", u.Host, err)
+			}
+			// HTTP-01 挑战：同一端口上的明文 HTTP 请求，另可通过 -acme-http 额外监听（如 :80）
+			tlsLn, httpLn := splitTLSListener(ln)
+			challenge := acmeHTTPHandler(manager)
+			go func() { _ = http.Serve(httpLn, challenge) }()
+			if acmeHTTPAddr != "" {
+				extra, err := listenInherited(acmeHTTPAddr)
+				if err != nil {
+					log.Fatalf("监听失败 %s: %v", acmeHTTPAddr, err)
+				}
+				go func() { serveExit(http.Serve(extra, challenge)) }()
+			}
+			log.Printf("WebSocket 服务端使用 ACME 证书启动，监听 %s%s", u.Host, path)
+			serveExit(server.ServeTLS(tlsLn, "", ""))
 		} else {
-			cert, err := generateSelfSignedCert()
+			// 证书按 SNI 选择，文件变化或 SIGHUP 时重新加载，无需重启
+			certs, err := newServerCertStore(u)
 			if err != nil {
-				log.Fatalf("生成自签名证书时出错: %v", err)
+				log.Fatal(err)
 			}
-			tlsConfig := &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS13,
+			tlsConfig.GetCertificate = certs.GetCertificate
+			ln, err := listenServer(u.Host)
+			if err != nil {
+				log.Fatalf("监听失败 %s: %v", u.Host, err)
 			}
-			server.TLSConfig = tlsConfig
-			log.Printf("WebSocket 服务端使用自签名证书启动，监听 %s%s", u.Host, path)
-			log.Fatal(server.ListenAndServeTLS("", ""))
+			log.Printf("WebSocket 服务端启动，监听 %s%s", u.Host, path)
+			serveExit(server.ServeTLS(ln, "", ""))
 		}
 	} else {
-		log.Printf("WebSocket 服务端启动，监听 %s%s", u.Host, path)
-		log.Fatal(http.ListenAndServe(u.Host, nil))
+		ln, err := listenServer(bind)
+		if err != nil {
+			log.Fatalf("监听失败 %s: %v", bind, err)
+		}
+		log.Printf("WebSocket 服务端启动，监听 %s%s", bind, path)
+		serveExit(http.Serve(ln, nil))
+	}
+}
+
+// tunnelGate 服务端通道准入检查（来源 IP、Token/用户、请求头部）
+type tunnelGate struct {
+	allowedNets    []*net.IPNet
+	requiredHeader http.Header
+	users          *userDB
+}
+
+// newTunnelGate 根据命令行参数创建准入检查
+func newTunnelGate() (*tunnelGate, error) {
+	g := &tunnelGate{}
+	// 解析多个 CIDR 范围
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, allowedNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("无法解析 CIDR: %v", err)
+		}
+		g.allowedNets = append(g.allowedNets, allowedNet)
+	}
+
+	requiredHeader, err := parseHeaderList(requireHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("解析 -require-header 失败: %v", err)
+	}
+	g.requiredHeader = requiredHeader
+
+	if g.users, err = getUserDB(); err != nil {
+		return nil, err
 	}
+	if _, err := getTrustedProxies(); err != nil {
+		return nil, err
+	}
+	if _, err := getEgressPolicy(); err != nil {
+		return nil, fmt.Errorf("解析目标访问策略失败: %v", err)
+	}
+	if _, _, err := getOutbounds(); err != nil {
+		return nil, fmt.Errorf("解析出站配置失败: %v", err)
+	}
+	if _, err := getTargetResolver(); err != nil {
+		return nil, err
+	}
+	return g, nil
 }
 
-// handleWebSocket 处理单个 WebSocket 连接
-func handleWebSocket(wsConn *websocket.Conn) {
+// authorize 检查通道建立请求，未通过时写出错误响应并返回 false
+func (g *tunnelGate) authorize(w http.ResponseWriter, r *http.Request) (peerInfo, bool) {
+	// 验证来源IP（经可信代理转发时为转发头部中的客户端 IP）
+	remoteAddr := realClientAddr(r)
+	clientIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		log.Printf("无法解析客户端地址: %v", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return peerInfo{}, false
+	}
+	clientIPAddr := net.ParseIP(clientIP)
+	allowed := false
+	for _, allowedNet := range g.allowedNets {
+		if allowedNet.Contains(clientIPAddr) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Printf("拒绝访问: IP %s 不在允许的范围内 (%s)", clientIP, cidrs)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return peerInfo{}, false
+	}
+
+	// 携带签名认证头部时校验签名（防重放），否则按 Subprotocol 令牌认证：
+	// 启用 -users 时按用户令牌认证，-token 仍作为无用户名的共享令牌
+	var user string
+	if signed := r.Header.Get(authHeaderName); signed != "" && (g.users != nil || authSecret != "") {
+		var authErr error
+		if user, authErr = g.verifySignedAuth(signed); authErr != nil {
+			log.Printf("签名认证失败，来自 %s: %v", remoteAddr, authErr)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return peerInfo{}, false
+		}
+	} else if clientToken := r.Header.Get("Sec-WebSocket-Protocol"); g.users != nil || token != "" || authSecret != "" {
+		var authErr error
+		if g.users != nil {
+			user, authErr = g.users.authenticate(clientToken)
+		}
+		if g.users == nil || authErr != nil {
+			if token == "" || !checkToken(clientToken) {
+				if authErr == nil {
+					authErr = errors.New("令牌无效")
+				}
+				log.Printf("Token验证失败，来自 %s: %v", remoteAddr, authErr)
+				w.Header().Set("Connection", "close")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return peerInfo{}, false
+			}
+		}
+	}
+
+	// 验证必需的请求头部
+	if !matchRequiredHeader(r.Header, g.requiredHeader) {
+		log.Printf("请求头部验证失败，来自 %s", remoteAddr)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return peerInfo{}, false
+	}
+
+	return peerInfo{addr: remoteAddr, identity: certIdentity(r.TLS), user: user}, true
+}
+
+// matchRequiredHeader 检查请求是否满足 -require-header 的全部要求（值为空时仅要求头部存在）
+func matchRequiredHeader(header, required http.Header) bool {
+	for k, values := range required {
+		for _, v := range values {
+			if v == "" {
+				if len(header.Values(k)) == 0 {
+					return false
+				}
+				continue
+			}
+			found := false
+			for _, got := range header.Values(k) {
+				if got == v {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// peerInfo 通道对端信息（用于日志与授权）
+type peerInfo struct {
+	addr     string // 客户端地址
+	identity string // 双向 TLS 客户端证书身份（CN/SAN），未提供证书时为空
+	user     string // -users 认证的用户名，使用共享 -token 或未启用认证时为空
+}
+
+func (p peerInfo) String() string {
+	s := p.addr
+	if p.user != "" {
+		s = p.user + "@" + s
+	}
+	if p.identity != "" {
+		s += " [" + p.identity + "]"
+	}
+	return s
+}
+
+// handleWebSocket 处理单个 WebSocket 连接，slot 用于限制并登记通道内的流
+func handleWebSocket(wsConn tunnelConn, peer peerInfo, slot *channelSlot) {
 	// 创建一个 context 用于通知所有 goroutine 退出
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // 函数退出时取消所有子 goroutine
@@ -176,8 +346,9 @@ func handleWebSocket(wsConn *websocket.Conn) {
 	conns := make(map[string]net.Conn)
 
 	// UDP 连接管理
-	udpConns := make(map[string]*net.UDPConn)
+	udpConns := make(map[string]udpSocket)
 	udpTargets := make(map[string]*net.UDPAddr)
+	udpStreams := make(map[string]*streamSlot)
 
 	defer func() {
 		// 先取消所有 goroutine
@@ -198,15 +369,20 @@ func handleWebSocket(wsConn *websocket.Conn) {
 			_ = uc.Close()
 			log.Printf("[服务端] 清理UDP连接: %s", id)
 		}
-		udpConns = make(map[string]*net.UDPConn)
+		udpConns = make(map[string]udpSocket)
 		udpTargets = make(map[string]*net.UDPAddr)
+		udpStreams = make(map[string]*streamSlot)
 		connMu.Unlock()
 
 		// 最后关闭 WebSocket
 		_ = wsConn.Close()
-		log.Printf("WebSocket 连接 %s 已完全清理", wsConn.RemoteAddr())
+		log.Printf("WebSocket 连接 %s 已完全清理", peer)
 	}()
 
+	// 用户被删除、禁用或过期时关闭通道
+	revokeOnUserChange(ctx.Done(), peer, func() { _ = wsConn.Close() })
+	slot.setCloser(func() { _ = wsConn.Close() })
+
 	// 设置WebSocket保活
 	wsConn.SetPingHandler(func(message string) error {
 		mu.Lock()
@@ -218,7 +394,7 @@ func handleWebSocket(wsConn *websocket.Conn) {
 		typ, msg, readErr := wsConn.ReadMessage()
 		if readErr != nil {
 			if !isNormalCloseError(readErr) {
-				log.Printf("WebSocket 读取失败 %s: %v", wsConn.RemoteAddr(), readErr)
+				log.Printf("WebSocket 读取失败 %s: %v", peer, readErr)
 			}
 			return // defer 会触发清理
 		}
@@ -235,12 +411,16 @@ func handleWebSocket(wsConn *websocket.Conn) {
 					connMu.RLock()
 					udpConn, ok1 := udpConns[connID]
 					targetAddr, ok2 := udpTargets[connID]
+					st := udpStreams[connID]
 					connMu.RUnlock()
 					if ok1 {
 						if ok2 {
 							if _, err := udpConn.WriteToUDP(data, targetAddr); err != nil {
 								log.Printf("[服务端UDP:%s] 发送到目标失败: %v", connID, err)
 							} else {
+								if st != nil {
+									st.addUp(len(data))
+								}
 								log.Printf("[服务端UDP:%s] 已发送数据到 %s，大小: %d", connID, targetAddr.String(), len(data))
 							}
 						}
@@ -280,21 +460,20 @@ func handleWebSocket(wsConn *websocket.Conn) {
 				targetAddr := parts[1]
 				log.Printf("[服务端UDP:%s] 收到UDP连接请求，目标: %s", connID, targetAddr)
 
-				udpAddr, err := net.ResolveUDPAddr("udp", targetAddr)
-				if err != nil {
-					log.Printf("[服务端UDP:%s] 解析目标地址失败: %v", connID, err)
-					mu.Lock()
-					_ = wsConn.WriteMessage(websocket.TextMessage, []byte("UDP_ERROR:"+connID+"|解析地址失败"))
-					mu.Unlock()
-					continue
+				// 为每个 UDP 连接创建独立的套接字（经所选出站）
+				st, err := slot.acquireStream(connID, "udp", targetAddr)
+				var udpConn udpSocket
+				var udpAddr *net.UDPAddr
+				if err == nil {
+					if udpConn, udpAddr, err = listenUDPTarget(ctx, peer, targetAddr); err != nil {
+						st.release()
+					}
 				}
-
-				// 为每个 UDP 连接创建独立的套接字
-				udpConn, err := net.ListenUDP("udp", nil)
 				if err != nil {
-					log.Printf("[服务端UDP:%s] 创建UDP套接字失败: %v", connID, err)
+					log.Printf("[服务端UDP:%s] 目标不可用: %v", connID, err)
 					mu.Lock()
-					_ = wsConn.WriteMessage(websocket.TextMessage, []byte("UDP_ERROR:"+connID+"|创建UDP失败"))
+					_ = wsConn.WriteMessage(websocket.TextMessage, refusalFrame(connID, err))
+					_ = wsConn.WriteMessage(websocket.TextMessage, []byte("UDP_ERROR:"+connID+"|"+err.Error()))
 					mu.Unlock()
 					continue
 				}
@@ -302,14 +481,18 @@ func handleWebSocket(wsConn *websocket.Conn) {
 				connMu.Lock()
 				udpConns[connID] = udpConn
 				udpTargets[connID] = udpAddr
+				udpStreams[connID] = st
 				connMu.Unlock()
+				st.setCloser(func() { _ = udpConn.Close() })
 
 				// 启动 UDP 接收 goroutine（监听 context 取消）
-				go func(cID string, uc *net.UDPConn, ctx context.Context) {
+				go func(cID string, uc udpSocket, ctx context.Context) {
+					defer st.release()
 					defer func() {
 						connMu.Lock()
 						delete(udpConns, cID)
 						delete(udpTargets, cID)
+						delete(udpStreams, cID)
 						connMu.Unlock()
 						_ = uc.Close()
 					}()
@@ -337,6 +520,7 @@ func handleWebSocket(wsConn *websocket.Conn) {
 						}
 
 						log.Printf("[服务端UDP:%s] 收到响应来自 %s，大小: %d", cID, addr.String(), n)
+						st.addDown(n)
 
 						// 构建响应消息: UDP_DATA:<connID>|<host>:<port>|<data>
 						host, portStr, _ := net.SplitHostPort(addr.String())
@@ -367,6 +551,7 @@ func handleWebSocket(wsConn *websocket.Conn) {
 				_ = uc.Close()
 				delete(udpConns, connID)
 				delete(udpTargets, connID)
+				delete(udpStreams, connID)
 				log.Printf("[服务端UDP:%s] 连接已关闭", connID)
 			}
 			connMu.Unlock()
@@ -399,8 +584,21 @@ func handleWebSocket(wsConn *websocket.Conn) {
 
 				log.Printf("[服务端] 请求TCP转发，连接ID: %s，目标: %s，首帧长度: %d", connID, targetAddr, len(firstFrameData))
 
+				// 超出并发流或新建速率限制时以 REFUSED 拒绝
+				st, err := slot.acquireStream(connID, "tcp", targetAddr)
+				if err != nil {
+					mu.Lock()
+					_ = wsConn.WriteMessage(websocket.TextMessage, refusalFrame(connID, err))
+					_ = wsConn.WriteMessage(websocket.TextMessage, []byte("CLOSE:"+connID))
+					mu.Unlock()
+					continue
+				}
+
 				// 启动连接处理 goroutine（传入 ctx）
-				go handleTCPConnection(ctx, connID, targetAddr, firstFrameData, wsConn, &mu, &connMu, conns)
+				go func() {
+					defer st.release()
+					handleTCPConnection(ctx, peer, st, connID, targetAddr, firstFrameData, wsConn, &mu, &connMu, conns)
+				}()
 			}
 			continue
 		} else if strings.HasPrefix(data, "DATA:") {
@@ -436,20 +634,27 @@ func handleWebSocket(wsConn *websocket.Conn) {
 // handleTCPConnection 处理单个 TCP 连接（独立的函数，监听 context）
 func handleTCPConnection(
 	ctx context.Context,
+	peer peerInfo,
+	st *streamSlot,
 	connID, targetAddr, firstFrameData string,
-	wsConn *websocket.Conn,
+	wsConn tunnelConn,
 	mu *sync.Mutex,
 	connMu *sync.RWMutex,
 	conns map[string]net.Conn,
 ) {
-	tcpConn, err := net.Dial("tcp", targetAddr)
+	// 按目标访问策略解析并连接；被拒绝或失败时先发送 REFUSED 说明原因，再发送 CLOSE
+	tcpConn, err := dialTarget(ctx, peer, targetAddr)
 	if err != nil {
 		log.Printf("[服务端] 连接目标地址 %s 失败: %v", targetAddr, err)
 		mu.Lock()
+		_ = wsConn.WriteMessage(websocket.TextMessage, refusalFrame(connID, err))
 		_ = wsConn.WriteMessage(websocket.TextMessage, []byte("CLOSE:"+connID))
 		mu.Unlock()
 		return
 	}
+	// 统计流量，管理接口可关闭该连接
+	tcpConn = &countingConn{Conn: tcpConn, st: st}
+	st.setCloser(func() { _ = tcpConn.Close() })
 
 	// 保存连接
 	connMu.Lock()